@@ -0,0 +1,79 @@
+package mlog
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap/zapcore"
+)
+
+var dropTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "mosdns",
+	Subsystem: "log_sink",
+	Name:      "dropped_total",
+	Help:      "The total number of log entries dropped because a sink's queue was full.",
+}, []string{"sink"})
+
+func init() {
+	prometheus.MustRegister(dropTotal)
+}
+
+// logItem is one queued entry waiting for asyncCore's writer goroutine.
+type logItem struct {
+	core   zapcore.Core // the With-accumulated inner core to write through
+	entry  zapcore.Entry
+	fields []zapcore.Field
+}
+
+// asyncCore wraps another zapcore.Core with a bounded channel so that a
+// slow or unreachable sink (e.g. a syslog server that stopped
+// responding) can never block query processing. Entries are dropped,
+// not queued indefinitely, once the channel is full.
+type asyncCore struct {
+	zapcore.Core
+	items   chan logItem
+	dropped prometheus.Counter
+}
+
+func newAsyncCore(inner zapcore.Core, queueSize int, name string) zapcore.Core {
+	c := &asyncCore{
+		Core:    inner,
+		items:   make(chan logItem, queueSize),
+		dropped: dropTotal.WithLabelValues(name),
+	}
+	go c.run()
+	return c
+}
+
+func (c *asyncCore) run() {
+	for it := range c.items {
+		_ = it.core.Write(it.entry, it.fields)
+	}
+}
+
+func (c *asyncCore) Write(e zapcore.Entry, fields []zapcore.Field) error {
+	select {
+	case c.items <- logItem{core: c.Core, entry: e, fields: fields}:
+	default:
+		c.dropped.Inc()
+	}
+	return nil
+}
+
+func (c *asyncCore) Check(e zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Core.Enabled(e.Level) {
+		return ce.AddCore(e, c)
+	}
+	return ce
+}
+
+// With must be overridden: the embedded zapcore.Core's own With returns
+// a core of the inner type, not an asyncCore, so a logger built via
+// .With(...) (the common path for per-query fields) would otherwise
+// write synchronously straight to the wrapped sink, bypassing the queue
+// this type exists to provide.
+func (c *asyncCore) With(fields []zapcore.Field) zapcore.Core {
+	return &asyncCore{
+		Core:    c.Core.With(fields),
+		items:   c.items,
+		dropped: c.dropped,
+	}
+}
@@ -0,0 +1,163 @@
+package mlog
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// JSONTCPArgs configures a line-delimited JSON over TCP sink.
+type JSONTCPArgs struct {
+	Addr string `yaml:"addr"` // Required.
+
+	// DialTimeout bounds each (re)connect attempt. Default is 5s.
+	DialTimeout int `yaml:"dial_timeout"`
+
+	// Level is the minimum zap level this sink accepts, independent of
+	// the process-wide level returned by mlog.Level(). Empty means no
+	// filter of the sink's own: it accepts every level, Debug included,
+	// whatever mlog.Level() is set to.
+	Level string `yaml:"level"`
+}
+
+const (
+	jsonTCPMinBackoff = time.Second
+	jsonTCPMaxBackoff = time.Minute
+)
+
+func newJSONTCPCore(args JSONTCPArgs) (zapcore.Core, error) {
+	if len(args.Addr) == 0 {
+		return nil, fmt.Errorf("json_tcp sink requires addr")
+	}
+	dialTimeout := time.Duration(args.DialTimeout) * time.Second
+	if dialTimeout <= 0 {
+		dialTimeout = 5 * time.Second
+	}
+	minLevel, filtered, err := parseSinkLevel(args.Level)
+	if err != nil {
+		return nil, err
+	}
+
+	encoderCfg := zapcore.EncoderConfig{
+		MessageKey:     "msg",
+		LevelKey:       "level",
+		TimeKey:        "ts",
+		NameKey:        "logger",
+		EncodeLevel:    zapcore.LowercaseLevelEncoder,
+		EncodeTime:     zapcore.ISO8601TimeEncoder,
+		EncodeDuration: zapcore.StringDurationEncoder,
+		LineEnding:     "\n",
+	}
+
+	c := &jsonTCPCore{
+		addr:        args.Addr,
+		dialTimeout: dialTimeout,
+		encoder:     zapcore.NewJSONEncoder(encoderCfg),
+		shared:      &jsonTCPConn{backoff: jsonTCPMinBackoff},
+		minLevel:    minLevel,
+		filtered:    filtered,
+	}
+	return c, nil
+}
+
+// jsonTCPConn holds the live connection and backoff state that must be
+// shared by every core produced from the same sink via With, instead of
+// copied, so loggers built for a single query still write through the
+// one pooled/backing-off connection.
+type jsonTCPConn struct {
+	mu       sync.Mutex
+	conn     net.Conn
+	backoff  time.Duration
+	nextDial time.Time
+}
+
+// jsonTCPCore reconnects with exponential backoff whenever the
+// connection is lost, instead of failing log writes permanently.
+type jsonTCPCore struct {
+	addr        string
+	dialTimeout time.Duration
+	encoder     zapcore.Encoder
+	shared      *jsonTCPConn
+
+	minLevel zapcore.Level
+	filtered bool
+}
+
+func (c *jsonTCPCore) Enabled(lvl zapcore.Level) bool {
+	if !c.filtered {
+		return true
+	}
+	return lvl >= c.minLevel
+}
+
+func (c *jsonTCPCore) With(fields []zapcore.Field) zapcore.Core {
+	clone := *c
+	clone.encoder = c.encoder.Clone()
+	for _, f := range fields {
+		f.AddTo(clone.encoder)
+	}
+	return &clone
+}
+
+func (c *jsonTCPCore) Check(e zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	return ce.AddCore(e, c)
+}
+
+func (c *jsonTCPCore) Write(e zapcore.Entry, fields []zapcore.Field) error {
+	buf, err := c.encoder.EncodeEntry(e, fields)
+	if err != nil {
+		return err
+	}
+	defer buf.Free()
+
+	conn, err := c.ensureConn()
+	if err != nil {
+		return err // entry is dropped; asyncCore already shields callers from blocking.
+	}
+	if _, err := conn.Write(buf.Bytes()); err != nil {
+		c.shared.mu.Lock()
+		c.shared.conn = nil
+		c.shared.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+func (c *jsonTCPCore) ensureConn() (net.Conn, error) {
+	s := c.shared
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn != nil {
+		return s.conn, nil
+	}
+	if time.Now().Before(s.nextDial) {
+		return nil, fmt.Errorf("json_tcp: backing off until %s", s.nextDial)
+	}
+
+	conn, err := net.DialTimeout("tcp", c.addr, c.dialTimeout)
+	if err != nil {
+		s.backoff *= 2
+		if s.backoff > jsonTCPMaxBackoff {
+			s.backoff = jsonTCPMaxBackoff
+		}
+		s.nextDial = time.Now().Add(s.backoff)
+		return nil, fmt.Errorf("failed to dial %s, %w", c.addr, err)
+	}
+	s.backoff = jsonTCPMinBackoff
+	s.conn = conn
+	return conn, nil
+}
+
+func (c *jsonTCPCore) Sync() error {
+	s := c.shared
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn != nil {
+		return s.conn.Close()
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package mlog
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+)
+
+func TestJSONTCPCoreWriteWithFields(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+
+	core, err := newJSONTCPCore(JSONTCPArgs{Addr: ln.Addr().String()})
+	if err != nil {
+		t.Fatalf("newJSONTCPCore: %v", err)
+	}
+	withCore := core.With([]zapcore.Field{zapcore.Field{Key: "qname", Type: zapcore.StringType, String: "example.com."}})
+
+	if err := withCore.Write(zapcore.Entry{Message: "hello"}, nil); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	var conn net.Conn
+	select {
+	case conn = <-accepted:
+	case <-time.After(time.Second):
+		t.Fatal("server never accepted a connection")
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if !strings.Contains(line, `"msg":"hello"`) || !strings.Contains(line, `"qname":"example.com."`) {
+		t.Errorf("unexpected line %q: want it to contain both msg and fields accumulated via With", line)
+	}
+}
+
+func TestJSONTCPCoreRejectsInvalidLevel(t *testing.T) {
+	if _, err := newJSONTCPCore(JSONTCPArgs{Addr: "127.0.0.1:1", Level: "not_a_level"}); err == nil {
+		t.Fatalf("newJSONTCPCore with invalid level: want error, got nil")
+	}
+}
+
+func TestJSONTCPCoreEnabledUnfilteredByDefault(t *testing.T) {
+	c := &jsonTCPCore{}
+	if !c.Enabled(zapcore.DebugLevel) {
+		t.Errorf("Enabled(Debug) with no configured Level = false, want true")
+	}
+}
+
+func TestJSONTCPCoreEnabledFiltersBelowMinLevel(t *testing.T) {
+	c := &jsonTCPCore{minLevel: zapcore.WarnLevel, filtered: true}
+	if c.Enabled(zapcore.InfoLevel) {
+		t.Errorf("Enabled(Info) with min level warn = true, want false")
+	}
+	if !c.Enabled(zapcore.ErrorLevel) {
+		t.Errorf("Enabled(Error) with min level warn = false, want true")
+	}
+}
@@ -0,0 +1,55 @@
+// Package mlog provides the process-wide zap logger used by mosdns and
+// its plugins, and the sink fan-out described in sink.go.
+package mlog
+
+import (
+	"os"
+	"sync"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+var (
+	mu     sync.Mutex
+	lvl    = zap.NewAtomicLevelAt(zap.InfoLevel)
+	logger = newDefaultLogger(lvl)
+	sugar  = logger.Sugar()
+)
+
+func newDefaultLogger(lvl zap.AtomicLevel) *zap.Logger {
+	encoderCfg := zap.NewProductionEncoderConfig()
+	encoderCfg.EncodeTime = zapcore.ISO8601TimeEncoder
+	core := zapcore.NewCore(zapcore.NewConsoleEncoder(encoderCfg), zapcore.Lock(os.Stderr), lvl)
+	return zap.New(core)
+}
+
+// L returns the shared logger.
+func L() *zap.Logger {
+	mu.Lock()
+	defer mu.Unlock()
+	return logger
+}
+
+// S returns the shared sugared logger.
+func S() *zap.SugaredLogger {
+	mu.Lock()
+	defer mu.Unlock()
+	return sugar
+}
+
+// Level returns the atomic level controlling the default core. Sinks
+// added via SetSinks keep their own level filters and are unaffected.
+func Level() zap.AtomicLevel {
+	return lvl
+}
+
+// SetLogger replaces the shared logger, e.g. after wrapping it with
+// additional sinks via NewTee. Existing *zap.Logger values obtained
+// from L() before this call keep logging to the old core.
+func SetLogger(l *zap.Logger) {
+	mu.Lock()
+	defer mu.Unlock()
+	logger = l
+	sugar = l.Sugar()
+}
@@ -0,0 +1,87 @@
+package mlog
+
+import (
+	"fmt"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// SinkConfig describes one external log sink. Args is sink-type
+// specific; see syslog.go, gelf.go and json_tcp.go for their shapes.
+type SinkConfig struct {
+	Type string `yaml:"type"` // "syslog" | "gelf" | "json_tcp"
+
+	Syslog  *SyslogArgs  `yaml:"syslog"`
+	Gelf    *GelfArgs    `yaml:"gelf"`
+	JSONTCP *JSONTCPArgs `yaml:"json_tcp"`
+
+	// QueueSize bounds the number of buffered entries for this sink.
+	// Once full, new entries are dropped and counted by
+	// mosdns_log_sink_dropped_total instead of blocking the caller.
+	QueueSize int `yaml:"queue_size"`
+}
+
+const defaultQueueSize = 4096
+
+// parseSinkLevel parses a sink's Level arg. An empty string means the
+// sink applies no filtering of its own: it accepts every level, Debug
+// included, whatever the shared logger's Level() is set to.
+func parseSinkLevel(s string) (lvl zapcore.Level, filtered bool, err error) {
+	if len(s) == 0 {
+		return 0, false, nil
+	}
+	if err := lvl.UnmarshalText([]byte(s)); err != nil {
+		return 0, false, fmt.Errorf("invalid sink level %q, %w", s, err)
+	}
+	return lvl, true, nil
+}
+
+func newSink(cfg SinkConfig) (zapcore.Core, error) {
+	var inner zapcore.Core
+	var err error
+	switch cfg.Type {
+	case "syslog":
+		if cfg.Syslog == nil {
+			return nil, fmt.Errorf("sink type syslog requires a syslog config")
+		}
+		inner, err = newSyslogCore(*cfg.Syslog)
+	case "gelf":
+		if cfg.Gelf == nil {
+			return nil, fmt.Errorf("sink type gelf requires a gelf config")
+		}
+		inner, err = newGelfCore(*cfg.Gelf)
+	case "json_tcp":
+		if cfg.JSONTCP == nil {
+			return nil, fmt.Errorf("sink type json_tcp requires a json_tcp config")
+		}
+		inner, err = newJSONTCPCore(*cfg.JSONTCP)
+	default:
+		return nil, fmt.Errorf("unknown sink type %q", cfg.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	queueSize := cfg.QueueSize
+	if queueSize <= 0 {
+		queueSize = defaultQueueSize
+	}
+	return newAsyncCore(inner, queueSize, cfg.Type), nil
+}
+
+// SetSinks replaces the shared logger's core with a tee of the default
+// stderr core plus one core per configured sink. It is typically called
+// once during startup after the config has been parsed.
+func SetSinks(cfgs []SinkConfig) error {
+	cores := []zapcore.Core{newDefaultLogger(Level()).Core()}
+	for i, cfg := range cfgs {
+		core, err := newSink(cfg)
+		if err != nil {
+			return fmt.Errorf("sink #%d: %w", i, err)
+		}
+		cores = append(cores, core)
+	}
+	SetLogger(zap.New(zapcore.NewTee(cores...)))
+	return nil
+}
@@ -0,0 +1,373 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package acme lets the TLS-terminating servers (tcp_server, doh_server,
+// doq_server) obtain and renew certificates from an ACME CA such as
+// Let's Encrypt, instead of requiring operators to manage cert files by
+// hand. A Manager is shared by tag across server plugins via its
+// tls.Config GetCertificate hook.
+//
+// Current build scope: the file and Redis Store backends (see
+// StoreConfig) and the RFC2136 DNSProvider (see DNSProviderConfig) are
+// implemented. Etcd/BoltDB stores and the Cloudflare/Route53/ACME-DNS
+// providers are recognized by config but return an error at startup;
+// see the "not compiled into this build" paths in store.go and
+// challenge.go, tracked as follow-up work. There is also no
+// KV-watch/hot-reload yet: a Manager only picks up a certificate
+// another instance issued the next time it reads the Store itself (on
+// renewal or restart), not the moment the other instance writes it.
+package acme
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/acme"
+)
+
+// Config configures one named acme manager. Server plugins reference it
+// by Tag via `cert: {acme: <tag>, domains: [...]}`.
+type Config struct {
+	Tag string `yaml:"tag"`
+
+	// DirectoryURL is the ACME server's directory endpoint. Defaults to
+	// Let's Encrypt's production directory.
+	DirectoryURL string `yaml:"directory_url"`
+	Email        string `yaml:"email"`
+
+	// Challenge selects "http-01", "tls-alpn-01" or "dns-01".
+	Challenge string `yaml:"challenge"`
+	DNS01     *DNSProviderConfig `yaml:"dns01"`
+
+	// HTTPListen is parsed from config, but the Manager does not bind
+	// it: no helper listener is started for HTTP-01. HTTP-01 answers are
+	// only served where a caller mounts HTTPHandler on its own HTTP mux
+	// at /.well-known/acme-challenge/.
+	HTTPListen string `yaml:"http_listen"`
+
+	// Store backend. Default is a filesystem store under Dir.
+	Dir   string      `yaml:"dir"`
+	Store StoreConfig `yaml:"store"`
+
+	MustStaple bool `yaml:"must_staple"`
+
+	// RenewBefore is how long before expiry renewal is attempted.
+	// Default is 30 days.
+	RenewBeforeDays int `yaml:"renew_before_days"`
+}
+
+func (c *Config) init() {
+	if len(c.DirectoryURL) == 0 {
+		c.DirectoryURL = acme.LetsEncryptURL
+	}
+	if len(c.Challenge) == 0 {
+		c.Challenge = "http-01"
+	}
+	if c.RenewBeforeDays <= 0 {
+		c.RenewBeforeDays = 30
+	}
+	if len(c.Dir) == 0 {
+		c.Dir = "acme"
+	}
+}
+
+// Manager obtains and renews certificates for a fixed set of domains
+// and serves them to TLS listeners via GetCertificate.
+type Manager struct {
+	cfg    Config
+	logger *zap.Logger
+	store  Store
+	client *acme.Client
+
+	httpChallenge *httpChallengeResponder
+	dns01         DNSProvider
+
+	// alpnMu guards alpnTokens, the per-domain CA-issued challenge
+	// tokens completeAuthorization records for the tls-alpn-01 case so
+	// GetCertificate can build the RFC 8555 key-authorization digest
+	// the CA actually expects instead of an empty one.
+	alpnMu     sync.Mutex
+	alpnTokens map[string]string
+
+	mu     sync.RWMutex
+	certs  map[string]*tls.Certificate // keyed by the cert's primary domain
+	closed chan struct{}
+}
+
+// NewManager creates a Manager and starts its background renewal loop.
+// domains is the full set of names this manager keeps certificates for;
+// a manager is typically shared by one or more server plugins that all
+// want the same certificate.
+func NewManager(cfg Config, domains []string, logger *zap.Logger) (*Manager, error) {
+	cfg.init()
+	if len(domains) == 0 {
+		return nil, fmt.Errorf("acme %s: no domains configured", cfg.Tag)
+	}
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+
+	store, err := newStore(cfg.Store, cfg.Dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to init acme store, %w", err)
+	}
+
+	accountKey, err := loadOrCreateAccountKey(store)
+	if err != nil {
+		return nil, fmt.Errorf("failed to init acme account key, %w", err)
+	}
+
+	client := &acme.Client{
+		Key:          accountKey,
+		DirectoryURL: cfg.DirectoryURL,
+	}
+
+	m := &Manager{
+		cfg:        cfg,
+		logger:     logger,
+		store:      store,
+		client:     client,
+		alpnTokens: make(map[string]string),
+		certs:      make(map[string]*tls.Certificate),
+		closed:     make(chan struct{}),
+	}
+
+	switch cfg.Challenge {
+	case "http-01":
+		m.httpChallenge = newHTTPChallengeResponder()
+	case "dns-01":
+		if cfg.DNS01 == nil {
+			return nil, fmt.Errorf("acme %s: dns-01 challenge requires a dns01 provider config", cfg.Tag)
+		}
+		p, err := newDNSProvider(*cfg.DNS01)
+		if err != nil {
+			return nil, fmt.Errorf("acme %s: %w", cfg.Tag, err)
+		}
+		m.dns01 = p
+	case "tls-alpn-01":
+		// Nothing to set up here: completeAuthorization records each
+		// challenge token in alpnTokens and GetCertificate answers from it.
+	default:
+		return nil, fmt.Errorf("acme %s: unknown challenge %q", cfg.Tag, cfg.Challenge)
+	}
+
+	if err := m.registerAccount(context.Background()); err != nil {
+		return nil, fmt.Errorf("failed to register acme account, %w", err)
+	}
+
+	if err := m.loadCached(domains); err != nil {
+		logger.Warn("failed to load cached acme certificates", zap.Error(err))
+	}
+
+	go m.renewLoop(domains)
+	go m.stapleLoop()
+	return m, nil
+}
+
+// Close stops the manager's background renewal and OCSP-refresh loops.
+func (m *Manager) Close() error {
+	close(m.closed)
+	return nil
+}
+
+// HTTPHandler returns the handler that must serve
+// /.well-known/acme-challenge/ for HTTP-01 validation. The Manager
+// starts no listener of its own for it (HTTPListen is not bound).
+func (m *Manager) HTTPHandler() interface{ ServeHTTPChallenge(token string) (string, bool) } {
+	return m.httpChallenge
+}
+
+// GetCertificate implements the tls.Config.GetCertificate hook. It also
+// answers TLS-ALPN-01 challenge connections transparently.
+func (m *Manager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if m.cfg.Challenge == "tls-alpn-01" {
+		for _, proto := range hello.SupportedProtos {
+			if proto == acme.ALPNProto {
+				return m.tlsALPN01Cert(hello.ServerName)
+			}
+		}
+	}
+
+	m.mu.RLock()
+	cert, ok := m.certs[hello.ServerName]
+	m.mu.RUnlock()
+	if ok {
+		return cert, nil
+	}
+
+	// Fall back to any cert we have; most deployments use a single
+	// domain per manager so this is the common path.
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, cert := range m.certs {
+		return cert, nil
+	}
+	return nil, fmt.Errorf("acme %s: no certificate available for %s", m.cfg.Tag, hello.ServerName)
+}
+
+// setALPNToken records the CA-issued challenge token for domain so a
+// concurrent GetCertificate call can build the matching challenge cert.
+func (m *Manager) setALPNToken(domain, token string) {
+	m.alpnMu.Lock()
+	m.alpnTokens[domain] = token
+	m.alpnMu.Unlock()
+}
+
+// clearALPNToken drops domain's token once its authorization has been
+// accepted, so a stale token can't be reused for a later order.
+func (m *Manager) clearALPNToken(domain string) {
+	m.alpnMu.Lock()
+	delete(m.alpnTokens, domain)
+	m.alpnMu.Unlock()
+}
+
+func (m *Manager) alpnToken(domain string) (string, bool) {
+	m.alpnMu.Lock()
+	defer m.alpnMu.Unlock()
+	token, ok := m.alpnTokens[domain]
+	return token, ok
+}
+
+func (m *Manager) tlsALPN01Cert(domain string) (*tls.Certificate, error) {
+	token, ok := m.alpnToken(domain)
+	if !ok {
+		return nil, fmt.Errorf("acme %s: no pending tls-alpn-01 challenge for %s", m.cfg.Tag, domain)
+	}
+	cert, err := m.client.TLSALPN01ChallengeCert(token, domain)
+	if err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
+
+func (m *Manager) registerAccount(ctx context.Context) error {
+	if _, err := m.client.Register(ctx, &acme.Account{Contact: []string{"mailto:" + m.cfg.Email}}, acme.AcceptTOS); err != nil {
+		if ae, ok := err.(*acme.Error); ok && ae.StatusCode == 409 {
+			return nil // already registered.
+		}
+		return err
+	}
+	return nil
+}
+
+func (m *Manager) renewLoop(domains []string) {
+	for {
+		wait := m.nextRenewal(domains)
+		select {
+		case <-m.closed:
+			return
+		case <-time.After(wait):
+		}
+		if err := m.obtain(context.Background(), domains); err != nil {
+			m.logger.Error("acme renewal failed, will retry", zap.Error(err))
+		}
+	}
+}
+
+// nextRenewal picks when to next attempt renewal: 30 days (configurable)
+// before the soonest-expiring certificate, with up to one hour of
+// jitter so that a fleet of mosdns instances sharing a KV store does
+// not all hit the CA at the same moment. With no certificate held yet it
+// returns the one-minute floor, so the first obtain runs almost at once.
+func (m *Manager) nextRenewal(domains []string) time.Duration {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var renewAt time.Time // zero until a parsable certificate is seen.
+	for _, cert := range m.certs {
+		if len(cert.Certificate) == 0 {
+			continue
+		}
+		x509Cert, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			continue
+		}
+		candidate := x509Cert.NotAfter.Add(-time.Duration(m.cfg.RenewBeforeDays) * 24 * time.Hour)
+		if renewAt.IsZero() || candidate.Before(renewAt) {
+			renewAt = candidate
+		}
+	}
+	jitter := time.Duration(randInt63n(int64(time.Hour)))
+	d := time.Until(renewAt) + jitter
+	if d < time.Minute {
+		d = time.Minute
+	}
+	return d
+}
+
+func (m *Manager) loadCached(domains []string) error {
+	for _, domain := range domains {
+		certPEM, keyPEM, err := m.store.LoadCert(domain)
+		if err != nil {
+			continue // not cached yet; renewLoop's first obtain() will fetch it.
+		}
+		cert, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			return err
+		}
+		m.mu.Lock()
+		m.certs[domain] = &cert
+		m.mu.Unlock()
+	}
+	return nil
+}
+
+func randInt63n(n int64) int64 {
+	b, err := rand.Int(rand.Reader, big.NewInt(n))
+	if err != nil {
+		return 0
+	}
+	return b.Int64()
+}
+
+func loadOrCreateAccountKey(store Store) (*ecdsa.PrivateKey, error) {
+	if der, err := store.LoadAccountKey(); err == nil {
+		key, err := x509.ParseECPrivateKey(der)
+		if err == nil {
+			return key, nil
+		}
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := store.SaveAccountKey(der); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func encodeKey(der []byte) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+}
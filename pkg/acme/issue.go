@@ -0,0 +1,168 @@
+package acme
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/acme"
+)
+
+// tlsFeatureOID is id-pe-tlsFeature (RFC 7633); status_request (value 5)
+// signals OCSP must-staple.
+var tlsFeatureOID = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 24}
+
+func mustStapleExtension() pkix.Extension {
+	v, _ := asn1.Marshal([]int{5})
+	return pkix.Extension{Id: tlsFeatureOID, Value: v}
+}
+
+// obtain runs a full ACME order: authorize each domain, fulfill
+// whichever challenge type this Manager is configured for, finalize the
+// order with a freshly generated key, and persist the result.
+func (m *Manager) obtain(ctx context.Context, domains []string) error {
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Minute)
+	defer cancel()
+
+	ids := make([]acme.AuthzID, len(domains))
+	for i, d := range domains {
+		ids[i] = acme.AuthzID{Type: "dns", Value: d}
+	}
+	order, err := m.client.AuthorizeOrder(ctx, ids)
+	if err != nil {
+		return fmt.Errorf("failed to create order, %w", err)
+	}
+
+	for _, authzURL := range order.AuthzURLs {
+		authz, err := m.client.GetAuthorization(ctx, authzURL)
+		if err != nil {
+			return fmt.Errorf("failed to fetch authorization, %w", err)
+		}
+		if authz.Status == acme.StatusValid {
+			continue
+		}
+		if err := m.completeAuthorization(ctx, authz); err != nil {
+			return fmt.Errorf("failed to complete challenge for %s, %w", authz.Identifier.Value, err)
+		}
+	}
+
+	order, err = m.client.WaitOrder(ctx, order.URI)
+	if err != nil {
+		return fmt.Errorf("order did not become ready, %w", err)
+	}
+
+	certKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	csr, err := makeCSR(certKey, domains, m.cfg.MustStaple)
+	if err != nil {
+		return fmt.Errorf("failed to build csr, %w", err)
+	}
+	der, _, err := m.client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return fmt.Errorf("failed to finalize order, %w", err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(certKey)
+	if err != nil {
+		return err
+	}
+	keyPEM := encodeKey(keyDER)
+	certPEM := encodeCertChain(der)
+
+	primary := domains[0]
+	if err := m.store.SaveCert(primary, certPEM, keyPEM); err != nil {
+		return fmt.Errorf("failed to persist certificate, %w", err)
+	}
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	m.certs[primary] = &cert
+	m.mu.Unlock()
+
+	m.logger.Info("obtained acme certificate", zap.Strings("domains", domains))
+	return nil
+}
+
+func (m *Manager) completeAuthorization(ctx context.Context, authz *acme.Authorization) error {
+	chal, err := m.pickChallenge(authz)
+	if err != nil {
+		return err
+	}
+
+	switch chal.Type {
+	case "http-01":
+		resp, err := m.client.HTTP01ChallengeResponse(chal.Token)
+		if err != nil {
+			return err
+		}
+		m.httpChallenge.setToken(chal.Token, resp)
+		defer m.httpChallenge.clearToken(chal.Token)
+	case "dns-01":
+		record, err := m.client.DNS01ChallengeRecord(chal.Token)
+		if err != nil {
+			return err
+		}
+		if err := m.dns01.Present(ctx, authz.Identifier.Value, record); err != nil {
+			return err
+		}
+		defer func() { _ = m.dns01.CleanUp(ctx, authz.Identifier.Value, record) }()
+	case "tls-alpn-01":
+		// GetCertificate answers ALPN validation connections with a
+		// self-signed challenge cert on demand, but it needs this
+		// authorization's CA-issued token to build the RFC 8555
+		// key-authorization digest the CA actually validates.
+		m.setALPNToken(authz.Identifier.Value, chal.Token)
+		defer m.clearALPNToken(authz.Identifier.Value)
+	default:
+		return fmt.Errorf("unsupported challenge type %q", chal.Type)
+	}
+
+	if _, err := m.client.Accept(ctx, chal); err != nil {
+		return err
+	}
+	_, err = m.client.WaitAuthorization(ctx, authz.URI)
+	return err
+}
+
+func (m *Manager) pickChallenge(authz *acme.Authorization) (*acme.Challenge, error) {
+	for _, c := range authz.Challenges {
+		if c.Type == m.cfg.Challenge {
+			return c, nil
+		}
+	}
+	return nil, fmt.Errorf("CA did not offer a %s challenge for %s", m.cfg.Challenge, authz.Identifier.Value)
+}
+
+func makeCSR(key *ecdsa.PrivateKey, domains []string, mustStaple bool) ([]byte, error) {
+	tmpl := &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: domains[0]},
+		DNSNames: domains,
+	}
+	if mustStaple {
+		// id-pe-tlsFeature OID, value "status_request" (OCSP must-staple).
+		tmpl.ExtraExtensions = append(tmpl.ExtraExtensions, mustStapleExtension())
+	}
+	return x509.CreateCertificateRequest(rand.Reader, tmpl, key)
+}
+
+func encodeCertChain(der [][]byte) []byte {
+	var out []byte
+	for _, b := range der {
+		out = append(out, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: b})...)
+	}
+	return out
+}
@@ -0,0 +1,105 @@
+package acme
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ocsp"
+)
+
+// stapleLoop periodically fetches a fresh OCSP response for the
+// manager's certificates and attaches it as cert.OCSPStaple so TLS
+// handshakes can staple it without a separate round trip to the CA.
+func (m *Manager) stapleLoop() {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.closed:
+			return
+		case <-ticker.C:
+			m.refreshStaples()
+		}
+	}
+}
+
+func (m *Manager) refreshStaples() {
+	m.mu.RLock()
+	certs := make(map[string]*tls.Certificate, len(m.certs))
+	for domain, cert := range m.certs {
+		certs[domain] = cert
+	}
+	m.mu.RUnlock()
+
+	for domain, cert := range certs {
+		staple, err := fetchOCSPStaple(cert)
+		if err != nil {
+			m.logger.Warn("failed to refresh OCSP staple", zap.String("domain", domain), zap.Error(err))
+			continue
+		}
+		m.mu.Lock()
+		if cur, ok := m.certs[domain]; ok {
+			// Replace the map entry with a new *tls.Certificate rather
+			// than mutating cur in place: cur may be the exact pointer
+			// GetCertificate already handed to an in-flight TLS
+			// handshake, which reads it with no synchronization of its
+			// own.
+			next := *cur
+			next.OCSPStaple = staple
+			m.certs[domain] = &next
+		}
+		m.mu.Unlock()
+	}
+}
+
+func fetchOCSPStaple(cert *tls.Certificate) ([]byte, error) {
+	if len(cert.Certificate) < 2 {
+		return nil, fmt.Errorf("certificate chain has no issuer to query OCSP against")
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	issuer, err := x509.ParseCertificate(cert.Certificate[1])
+	if err != nil {
+		return nil, err
+	}
+	if len(leaf.OCSPServer) == 0 {
+		return nil, fmt.Errorf("certificate has no OCSP responder")
+	}
+
+	req, err := ocsp.CreateRequest(leaf, issuer, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, leaf.OCSPServer[0], bytes.NewReader(req))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/ocsp-request")
+
+	resp, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := ocsp.ParseResponse(body, issuer); err != nil {
+		return nil, err
+	}
+	return body, nil
+}
@@ -0,0 +1,24 @@
+package acme
+
+import "sync"
+
+// registry holds every Manager created from the top-level `acme:` config
+// block, keyed by its Tag. Server plugins (tcp_server, doh_server,
+// doq_server) look a manager up by tag when their own args carry
+// `cert: {acme: <tag>, domains: [...]}` instead of a static cert/key pair.
+var registry sync.Map // tag string -> *Manager
+
+// Register makes m available to server plugins via its Tag. Called once
+// per `acme:` entry while the config is being loaded.
+func Register(m *Manager) {
+	registry.Store(m.cfg.Tag, m)
+}
+
+// Get returns the Manager registered under tag, if any.
+func Get(tag string) (*Manager, bool) {
+	v, ok := registry.Load(tag)
+	if !ok {
+		return nil, false
+	}
+	return v.(*Manager), true
+}
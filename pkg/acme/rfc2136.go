@@ -0,0 +1,97 @@
+package acme
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// RFC2136Args configures DNS-01 validation via dynamic DNS updates
+// (RFC 2136), e.g. against BIND or PowerDNS with an update key.
+type RFC2136Args struct {
+	Nameserver string `yaml:"nameserver"` // e.g. "ns1.example.com:53".
+	TSIGKey    string `yaml:"tsig_key"`
+	TSIGSecret string `yaml:"tsig_secret"`
+	// TTL for the TXT record, in seconds. Default is 60.
+	TTL int `yaml:"ttl"`
+}
+
+type rfc2136Provider struct {
+	args RFC2136Args
+}
+
+func newRFC2136Provider(args RFC2136Args) *rfc2136Provider {
+	if args.TTL <= 0 {
+		args.TTL = 60
+	}
+	return &rfc2136Provider{args: args}
+}
+
+func (p *rfc2136Provider) Present(ctx context.Context, domain, record string) error {
+	return p.update(ctx, domain, record, true)
+}
+
+func (p *rfc2136Provider) CleanUp(ctx context.Context, domain, record string) error {
+	return p.update(ctx, domain, record, false)
+}
+
+func (p *rfc2136Provider) update(ctx context.Context, domain, record string, present bool) error {
+	fqdn := dns.Fqdn("_acme-challenge." + domain)
+
+	m := new(dns.Msg)
+	m.SetUpdate(dns.Fqdn(zoneOf(domain)))
+	rr := &dns.TXT{
+		Hdr: dns.RR_Header{Name: fqdn, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: uint32(p.args.TTL)},
+		Txt: []string{record},
+	}
+	if present {
+		m.Insert([]dns.RR{rr})
+	} else {
+		m.Remove([]dns.RR{rr})
+	}
+
+	if len(p.args.TSIGKey) > 0 {
+		m.SetTsig(dns.Fqdn(p.args.TSIGKey), dns.HmacSHA256, 300, time.Now().Unix())
+	}
+
+	c := new(dns.Client)
+	if len(p.args.TSIGKey) > 0 {
+		c.TsigSecret = map[string]string{dns.Fqdn(p.args.TSIGKey): p.args.TSIGSecret}
+	}
+
+	reply, _, err := c.ExchangeContext(ctx, m, p.args.Nameserver)
+	if err != nil {
+		return fmt.Errorf("rfc2136 update failed, %w", err)
+	}
+	if reply.Rcode != dns.RcodeSuccess {
+		return fmt.Errorf("rfc2136 update rejected, rcode %s", dns.RcodeToString[reply.Rcode])
+	}
+	return nil
+}
+
+// zoneOf approximates the parent zone of domain by dropping its
+// left-most label. Operators with a more complex zone cut should split
+// the domain explicitly in their DNS-01 setup.
+func zoneOf(domain string) string {
+	domain = dns.Fqdn(domain)
+	i := strings.IndexByte(domain, '.')
+	if i < 0 {
+		return domain
+	}
+	return domain[i+1:]
+}
+
+func errMissingProviderArgs(name string) error {
+	return fmt.Errorf("dns01 provider %q requires its config block", name)
+}
+
+func errUnbuiltProvider(name string) error {
+	return fmt.Errorf("dns01 provider %q is not compiled into this build", name)
+}
+
+func errUnknownProvider(name string) error {
+	return fmt.Errorf("unknown dns01 provider %q", name)
+}
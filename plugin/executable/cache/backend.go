@@ -0,0 +1,297 @@
+package cache
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/cache"
+	"github.com/miekg/dns"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+// Backend is the storage behind the cache plugin. newBackend picks
+// memBackend by default, or a redisBackend when Args.Redis is set so
+// multiple mosdns instances behind a load balancer can share one warmed
+// cache instead of each keeping a cold local LRU.
+type Backend interface {
+	// Get returns the stored item and how long it has left to live.
+	// remaining <= 0 means the entry is expired but was still found
+	// (the lazy-cache window); the caller decides whether that's usable.
+	Get(k key) (v *item, remaining time.Duration, ok bool)
+	Set(k key, v *item, ttl time.Duration)
+	Len() int
+	Close() error
+}
+
+// LockableBackend is implemented by backends that can coordinate the
+// lazy-update refresh across every mosdns instance sharing them, so only
+// one instance upstream-refreshes a given expired key at a time.
+type LockableBackend interface {
+	// TryLock attempts to acquire a short-lived lock for msgKey. If
+	// locked is false, another instance already holds it; the caller
+	// should skip its own refresh. unlock is nil unless locked is true.
+	TryLock(msgKey string, ttl time.Duration) (locked bool, unlock func(), err error)
+}
+
+func newBackend(args *Args, logger *zap.Logger) Backend {
+	if args.Redis != nil {
+		return newRedisBackend(args.Redis, logger)
+	}
+	return newMemBackend(args.Size)
+}
+
+// memBackend is the default in-process LRU backend.
+type memBackend struct {
+	c *cache.Cache[key, *item]
+}
+
+func newMemBackend(size int) *memBackend {
+	return &memBackend{c: cache.New[key, *item](cache.Opts{Size: size})}
+}
+
+func (b *memBackend) Get(k key) (*item, time.Duration, bool) {
+	return b.c.Get(k)
+}
+
+func (b *memBackend) Set(k key, v *item, ttl time.Duration) {
+	b.c.Store(k, v, ttl)
+}
+
+func (b *memBackend) Len() int { return b.c.Len() }
+
+func (b *memBackend) Close() error { return nil }
+
+// walk iterates every live entry. Only used by dumpNow.
+func (b *memBackend) walk(f func(k key, v *item) bool) {
+	b.c.Range(f)
+}
+
+// restore inserts an entry loaded from a dump file, bypassing
+// saveRespToCache's "don't cache weird failures" policy since the entry
+// was already validated when it was first saved.
+func (b *memBackend) restore(k key, v *item) {
+	b.c.Store(k, v, v.ttl)
+}
+
+// RedisArgs configures the shared Redis-backed cache store. Setting it
+// moves NewCache off the local LRU/dump_file and onto Redis, the same
+// approach this project already uses to share ACME certs across a
+// clustered set of TLS-terminating servers.
+type RedisArgs struct {
+	Addr     string `yaml:"addr"` // Required. host:port.
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	DB       int    `yaml:"db"`
+
+	// KeyPrefix namespaces this cache's keys so several mosdns configs
+	// can share one Redis instance. Default "mosdns_cache:".
+	KeyPrefix string `yaml:"key_prefix"`
+
+	TLS *RedisTLSArgs `yaml:"tls"`
+}
+
+// RedisTLSArgs enables TLS on the Redis connection. All fields are
+// optional; CA/Cert/Key default to the system trust store / no client
+// cert.
+type RedisTLSArgs struct {
+	CA                 string `yaml:"ca"`
+	Cert               string `yaml:"cert"`
+	Key                string `yaml:"key"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+}
+
+const defaultRedisKeyPrefix = "mosdns_cache:"
+
+func (a *RedisArgs) init() {
+	if len(a.KeyPrefix) == 0 {
+		a.KeyPrefix = defaultRedisKeyPrefix
+	}
+}
+
+func (a *RedisTLSArgs) toTLSConfig() (*tls.Config, error) {
+	cfg := &tls.Config{InsecureSkipVerify: a.InsecureSkipVerify}
+
+	if len(a.CA) > 0 {
+		pem, err := os.ReadFile(a.CA)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read ca, %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificate found in ca file")
+		}
+		cfg.RootCAs = pool
+	}
+
+	if len(a.Cert) > 0 || len(a.Key) > 0 {
+		cert, err := tls.LoadX509KeyPair(a.Cert, a.Key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load cert/key, %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+// redisBackend stores entries as Redis strings, keyed by KeyPrefix plus
+// the hex-encoded msgKey (msgKey isn't UTF-8 safe, it's a raw qtype/
+// qclass/name blob) and encoded with the same dns wire format the
+// memBackend dump file uses, so the two are interchangeable if an
+// operator ever migrates a warmed dump into Redis by hand.
+type redisBackend struct {
+	args   *RedisArgs
+	logger *zap.Logger
+	rdb    *redis.Client
+}
+
+func newRedisBackend(args *RedisArgs, logger *zap.Logger) *redisBackend {
+	args.init()
+
+	opts := &redis.Options{
+		Addr:     args.Addr,
+		Username: args.Username,
+		Password: args.Password,
+		DB:       args.DB,
+	}
+	if args.TLS != nil {
+		tlsCfg, err := args.TLS.toTLSConfig()
+		if err != nil {
+			logger.Error("invalid redis tls config, falling back to plaintext", zap.Error(err))
+		} else {
+			opts.TLSConfig = tlsCfg
+		}
+	}
+
+	return &redisBackend{
+		args:   args,
+		logger: logger,
+		rdb:    redis.NewClient(opts),
+	}
+}
+
+func (b *redisBackend) redisKey(k key) string {
+	return b.args.KeyPrefix + hex.EncodeToString([]byte(k))
+}
+
+func (b *redisBackend) Get(k key) (*item, time.Duration, bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultLazyUpdateTimeout)
+	defer cancel()
+
+	wire, err := b.rdb.Get(ctx, b.redisKey(k)).Bytes()
+	if err != nil {
+		if !errors.Is(err, redis.Nil) {
+			b.logger.Warn("redis get failed", zap.Error(err))
+		}
+		return nil, 0, false
+	}
+
+	v, storedAt, err := unpackItem(wire)
+	if err != nil {
+		b.logger.Warn("failed to unpack cached entry", zap.Error(err))
+		return nil, 0, false
+	}
+
+	// remaining must reflect the record's real DNS TTL, not Redis's own
+	// countdown to deletion (Set deliberately extends that past ttl so
+	// the entry survives into the lazy-cache window). Otherwise a record
+	// past its real TTL but still inside the Redis window would look
+	// fresh forever and getRespFromCache would never trigger a refresh.
+	remaining := v.ttl - time.Since(storedAt)
+	return v, remaining, true
+}
+
+func (b *redisBackend) Set(k key, v *item, ttl time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultLazyUpdateTimeout)
+	defer cancel()
+
+	wire, err := packItem(v)
+	if err != nil {
+		b.logger.Warn("failed to pack cache entry for redis", zap.Error(err))
+		return
+	}
+	if err := b.rdb.Set(ctx, b.redisKey(k), wire, 0).Err(); err != nil {
+		b.logger.Warn("redis set failed", zap.Error(err))
+		return
+	}
+	if err := b.rdb.ExpireAt(ctx, b.redisKey(k), time.Now().Add(ttl)).Err(); err != nil {
+		b.logger.Warn("redis expireat failed", zap.Error(err))
+	}
+}
+
+func (b *redisBackend) Len() int {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultLazyUpdateTimeout)
+	defer cancel()
+	n, err := b.rdb.DBSize(ctx).Result()
+	if err != nil {
+		b.logger.Warn("redis dbsize failed", zap.Error(err))
+		return 0
+	}
+	return int(n)
+}
+
+func (b *redisBackend) Close() error {
+	return b.rdb.Close()
+}
+
+// TryLock implements LockableBackend using SETNX so only one mosdns
+// instance sharing this Redis backend upstream-refreshes a given expired
+// key at a time; the rest see doLazyUpdate return early.
+func (b *redisBackend) TryLock(msgKey string, ttl time.Duration) (bool, func(), error) {
+	ctx, cancel := context.WithTimeout(context.Background(), ttl)
+	defer cancel()
+
+	lockKey := b.args.KeyPrefix + "lock:" + hex.EncodeToString([]byte(msgKey))
+	ok, err := b.rdb.SetNX(ctx, lockKey, 1, ttl).Result()
+	if err != nil {
+		return false, nil, err
+	}
+	if !ok {
+		return false, nil, nil
+	}
+	unlock := func() {
+		ctx, cancel := context.WithTimeout(context.Background(), defaultLazyUpdateTimeout)
+		defer cancel()
+		if err := b.rdb.Del(ctx, lockKey).Err(); err != nil {
+			b.logger.Warn("failed to release redis lazy-update lock", zap.Error(err))
+		}
+	}
+	return true, unlock, nil
+}
+
+// packItem/unpackItem encode an *item as its dns wire-format answer
+// prefixed by the stored ttl and the unix-nano time it was stored at, so
+// a reader can recompute how much of that ttl is actually left instead
+// of relying on Redis's own per-key expiry (which redisBackend.Set
+// deliberately extends past ttl to cover the lazy-cache window).
+func packItem(v *item) ([]byte, error) {
+	wire, err := v.resp.Pack()
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 16+len(wire))
+	binary.BigEndian.PutUint64(buf[:8], uint64(v.ttl))
+	binary.BigEndian.PutUint64(buf[8:16], uint64(time.Now().UnixNano()))
+	copy(buf[16:], wire)
+	return buf, nil
+}
+
+func unpackItem(buf []byte) (v *item, storedAt time.Time, err error) {
+	if len(buf) < 16 {
+		return nil, time.Time{}, errors.New("cache entry too short")
+	}
+	ttl := time.Duration(binary.BigEndian.Uint64(buf[:8]))
+	storedAt = time.Unix(0, int64(binary.BigEndian.Uint64(buf[8:16])))
+	msg := new(dns.Msg)
+	if err := msg.Unpack(buf[16:]); err != nil {
+		return nil, time.Time{}, err
+	}
+	return &item{resp: msg, ttl: ttl}, storedAt, nil
+}
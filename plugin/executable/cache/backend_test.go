@@ -0,0 +1,63 @@
+package cache
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestPackUnpackItemRoundTrip(t *testing.T) {
+	resp := new(dns.Msg)
+	resp.SetQuestion("example.com.", dns.TypeA)
+
+	v := &item{resp: resp, ttl: 30 * time.Second}
+	wire, err := packItem(v)
+	if err != nil {
+		t.Fatalf("packItem: %v", err)
+	}
+
+	got, storedAt, err := unpackItem(wire)
+	if err != nil {
+		t.Fatalf("unpackItem: %v", err)
+	}
+	if got.ttl != v.ttl {
+		t.Errorf("ttl = %v, want %v", got.ttl, v.ttl)
+	}
+	if time.Since(storedAt) > time.Second {
+		t.Errorf("storedAt too far in the past: %v", storedAt)
+	}
+	if got.resp.Question[0].Name != "example.com." {
+		t.Errorf("unexpected question name %q", got.resp.Question[0].Name)
+	}
+}
+
+// TestRedisBackendRemainingReflectsRealTTL guards against the bug where
+// redisBackend.Get reported a record as "still fresh" using Redis's own
+// key TTL (the extended LazyCacheTTL storage window set by Set) instead
+// of the record's real DNS ttl. It exercises the same decode path
+// redisBackend.Get uses, with storedAt backdated past ttl but well
+// inside a typical LazyCacheTTL window.
+func TestRedisBackendRemainingReflectsRealTTL(t *testing.T) {
+	resp := new(dns.Msg)
+	resp.SetQuestion("example.com.", dns.TypeA)
+
+	ttl := 30 * time.Second
+	wire, err := packItem(&item{resp: resp, ttl: ttl})
+	if err != nil {
+		t.Fatalf("packItem: %v", err)
+	}
+
+	backdated := time.Now().Add(-2 * ttl).UnixNano()
+	binary.BigEndian.PutUint64(wire[8:16], uint64(backdated))
+
+	v, storedAt, err := unpackItem(wire)
+	if err != nil {
+		t.Fatalf("unpackItem: %v", err)
+	}
+	remaining := v.ttl - time.Since(storedAt)
+	if remaining > 0 {
+		t.Errorf("remaining = %v, want <= 0 for a record whose real ttl already elapsed", remaining)
+	}
+}
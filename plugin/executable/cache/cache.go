@@ -3,29 +3,24 @@ package cache
 import (
 	"context"
 	"encoding/binary"
-	"errors"
 	"fmt"
 	"io"
 	"net/http"
-	"os"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/IrineSistiana/mosdns/v5/coremain"
-	"github.com/IrineSistiana/mosdns/v5/pkg/cache"
-	"github.com/IrineSistiana/mosdns/v5/pkg/pool"
 	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
 	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
 	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
 	"github.com/go-chi/chi/v5"
-	"github.com/klauspost/compress/gzip"
 	"github.com/miekg/dns"
 	"github.com/prometheus/client_golang/prometheus"
 	"go.uber.org/zap"
 	"golang.org/x/sync/singleflight"
-	"google.golang.org/protobuf/proto"
 )
 
 const (
@@ -41,8 +36,12 @@ const (
 	defaultLazyUpdateTimeout = time.Second * 5
 	expiredMsgTtl            = 5
 
-	minimumChangesToDump   = 1024
-	dumpHeader             = "mosdns_cache_v2"
+	minimumChangesToDump = 1024
+	// dumpHeader was bumped to v3 when the dump format switched from a
+	// single gzip stream of length-prefixed entries to a sequence of
+	// self-contained, checksummed blocks (see dump.go); v2 dumps are
+	// incompatible and are rejected.
+	dumpHeader             = "mosdns_cache_v3"
 	dumpBlockSize          = 128
 	dumpMaximumBlockLength = 1 << 20 // 1M block. 8kb pre entry. Should be enough.
 )
@@ -54,37 +53,120 @@ type Args struct {
 	LazyCacheTTL int    `yaml:"lazy_cache_ttl"`
 	DumpFile     string `yaml:"dump_file"`
 	DumpInterval int    `yaml:"dump_interval"`
+	// DumpCompressor picks the per-block compressor used by the dump
+	// file: "gzip" (default) or "zstd", which trades a slower write for
+	// a notably smaller file on large caches.
+	DumpCompressor string `yaml:"dump_compressor"`
+	// DumpIncremental, when true, appends only the keys updated since
+	// the last dump as new blocks instead of re-serializing the whole
+	// cache every DumpInterval. Cheap for a large, mostly-stable cache;
+	// the tradeoff is that the dump file never shrinks: old blocks are
+	// not rewritten or compacted, a restart keeps appending to the same
+	// file, and loadDump replays every block in it.
+	DumpIncremental bool `yaml:"dump_incremental"`
+
+	// Redis, if set, moves the cache backend to a shared Redis instance
+	// so several mosdns replicas behind a load balancer can serve each
+	// other's warmed answers instead of each keeping a cold local LRU.
+	Redis *RedisArgs `yaml:"redis"`
+
+	// PrefetchThreshold turns on predictive warming: keys whose access
+	// popularity (an EWMA, range 0~1) is at or above this value are
+	// proactively refreshed before they expire, instead of waiting for
+	// a client to hit the lazy-cache window. 0 (default) disables it.
+	PrefetchThreshold float64 `yaml:"prefetch_threshold"`
+	// PrefetchTTLFraction is how close to expiry (as a fraction of the
+	// record's original ttl) a popular key has to be before it's
+	// refreshed. Default 0.1 (last 10% of its ttl).
+	PrefetchTTLFraction float64 `yaml:"prefetch_ttl_fraction"`
+	// PrefetchConcurrency bounds how many prefetchOne calls run at once
+	// per scheduler tick. Default 4. Each call only hands its refresh to
+	// doLazyUpdate, which runs it on a goroutine of its own, so this does
+	// not bound how many refreshes are in flight at once.
+	PrefetchConcurrency int `yaml:"prefetch_concurrency"`
 }
 
 func (a *Args) init() {
 	utils.SetDefaultUnsignNum(&a.Size, 1024)
 	utils.SetDefaultUnsignNum(&a.DumpInterval, 600)
+	if len(a.DumpCompressor) == 0 {
+		a.DumpCompressor = compressorNameGzip
+	}
+
+	if a.PrefetchThreshold > 0 {
+		if a.PrefetchTTLFraction <= 0 {
+			a.PrefetchTTLFraction = defaultPrefetchTTLFraction
+		}
+		utils.SetDefaultUnsignNum(&a.PrefetchConcurrency, defaultPrefetchConcurrency)
+	}
 }
 
-type key [16]byte
+// key is the cache key derived from getMsgKey. It is a distinct type
+// (rather than a bare string) so Backend implementations can't be called
+// with an un-normalized query key by mistake.
+type key string
+
 type item struct {
 	resp *dns.Msg
 	ttl  time.Duration
+	// seq is the Cache.updatedKey value this item was stored under. It
+	// lets dumpNow tell, without scanning the whole backend, which
+	// entries were touched since the last checkpoint (see
+	// Args.DumpIncremental).
+	seq uint64
 }
 
 func (i *item) Expired(ttl time.Duration) bool {
 	return i.ttl < ttl
 }
 
+func (c *Cache) getBackend() Backend {
+	c.backendMu.RLock()
+	defer c.backendMu.RUnlock()
+	return c.backend
+}
+
+// swapBackend installs next as the live backend and returns the one it
+// replaced, so the caller can Close it without holding backendMu.
+func (c *Cache) swapBackend(next Backend) Backend {
+	c.backendMu.Lock()
+	defer c.backendMu.Unlock()
+	prev := c.backend
+	c.backend = next
+	return prev
+}
+
 type Cache struct {
 	args *Args
 
-	logger       *zap.Logger
-	backend      *cache.Cache[key, *item]
-	lazyUpdateMap sync.Map // 存储每个 msgKey 的 singleflight.Group
-	closeOnce    sync.Once
-	closeNotify  chan struct{}
-	updatedKey   atomic.Uint64
-
-	queryTotal   prometheus.Counter
-	hitTotal     prometheus.Counter
-	lazyHitTotal prometheus.Counter
-	size         prometheus.GaugeFunc
+	logger *zap.Logger
+	// backendMu guards backend: /flush (Api) swaps it out from under a
+	// concurrently running Exec, which otherwise reads/writes it with no
+	// synchronization at all.
+	backendMu     sync.RWMutex
+	backend       Backend
+	lazyUpdateMap sync.Map // msgKey string -> *singleflight.Group
+	closeOnce     sync.Once
+	closeNotify   chan struct{}
+	updatedKey    atomic.Uint64
+
+	// lastDumpSeq is the updatedKey checkpoint as of the last dumpNow
+	// call; dumpBlockSeq is a monotonic counter stamped on every block
+	// written in this process's lifetime, for Args.DumpIncremental and
+	// the dump format's per-block sequence number respectively.
+	lastDumpSeq  atomic.Uint64
+	dumpBlockSeq atomic.Uint64
+
+	popMu      sync.Mutex
+	popularity map[key]*popRecord
+
+	queryTotal          prometheus.Counter
+	hitTotal            prometheus.Counter
+	lazyHitTotal        prometheus.Counter
+	prefetchTotal       prometheus.Counter
+	size                prometheus.GaugeFunc
+	dumpBytes           prometheus.Counter
+	dumpDurationSeconds prometheus.Histogram
 }
 
 func Init(bp *coremain.BP, args any) (any, error) {
@@ -128,13 +210,13 @@ func NewCache(args *Args, opts Opts) *Cache {
 		logger = zap.NewNop()
 	}
 
-	backend := cache.New[key, *item](cache.Opts{Size: args.Size})
+	backend := newBackend(args, logger)
 	lb := map[string]string{"tag": opts.MetricsTag}
 	p := &Cache{
 		args:        args,
 		logger:      logger,
-		backend:     backend,
 		closeNotify: make(chan struct{}),
+		popularity:  make(map[key]*popRecord),
 
 		queryTotal: prometheus.NewCounter(prometheus.CounterOpts{
 			Name:        "query_total",
@@ -151,25 +233,49 @@ func NewCache(args *Args, opts Opts) *Cache {
 			Help:        "The total number of queries that hit the expired cache",
 			ConstLabels: lb,
 		}),
-		size: prometheus.NewGaugeFunc(prometheus.GaugeOpts{
-			Name:        "size_current",
-			Help:        "Current cache size in records",
+		prefetchTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "prefetch_total",
+			Help:        "The total number of popular records proactively refreshed before expiry",
+			ConstLabels: lb,
+		}),
+		dumpBytes: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "dump_bytes",
+			Help:        "Total bytes written to the cache dump file",
 			ConstLabels: lb,
-		}, func() float64 {
-			return float64(backend.Len())
 		}),
+		dumpDurationSeconds: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:        "dump_duration_seconds",
+			Help:        "Time taken to write the cache dump file",
+			ConstLabels: lb,
+		}),
+	}
+	p.backend = backend
+	p.size = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name:        "size_current",
+		Help:        "Current cache size in records",
+		ConstLabels: lb,
+	}, func() float64 {
+		return float64(p.getBackend().Len())
+	})
+
+	// Remote backends (Redis) are shared by every mosdns instance, so
+	// there is nothing useful to dump/load from local disk.
+	if args.Redis == nil {
+		if err := p.loadDump(); err != nil {
+			p.logger.Error("failed to load cache dump", zap.Error(err))
+		}
+		p.startDumpLoop()
 	}
 
-	if err := p.loadDump(); err != nil {
-		p.logger.Error("failed to load cache dump", zap.Error(err))
+	if args.PrefetchThreshold > 0 {
+		p.startPrefetchLoop()
 	}
-	p.startDumpLoop()
 
 	return p
 }
 
 func (c *Cache) RegMetricsTo(r prometheus.Registerer) error {
-	for _, collector := range [...]prometheus.Collector{c.queryTotal, c.hitTotal, c.lazyHitTotal, c.size} {
+	for _, collector := range [...]prometheus.Collector{c.queryTotal, c.hitTotal, c.lazyHitTotal, c.prefetchTotal, c.size, c.dumpBytes, c.dumpDurationSeconds} {
 		if err := r.Register(collector); err != nil {
 			return err
 		}
@@ -186,7 +292,12 @@ func (c *Cache) Exec(ctx context.Context, qCtx *query_context.Context, next sequ
 		return next.ExecNext(ctx, qCtx)
 	}
 
-	cachedResp, lazyHit := getRespFromCache(msgKey, c.backend, c.args.LazyCacheTTL > 0, expiredMsgTtl)
+	if c.args.PrefetchThreshold > 0 {
+		c.recordAccess(toKey(msgKey), next)
+	}
+
+	backend := c.getBackend()
+	cachedResp, lazyHit := getRespFromCache(msgKey, backend, c.args.LazyCacheTTL > 0, expiredMsgTtl)
 	if lazyHit {
 		c.lazyHitTotal.Inc()
 		c.doLazyUpdate(msgKey, qCtx, next)
@@ -200,14 +311,16 @@ func (c *Cache) Exec(ctx context.Context, qCtx *query_context.Context, next sequ
 	err := next.ExecNext(ctx, qCtx)
 
 	if r := qCtx.R(); r != nil && cachedResp != r { // pointer compare. r is not cachedResp
-		saveRespToCache(msgKey, r, c.backend, c.args.LazyCacheTTL)
-		c.updatedKey.Add(1)
+		saveRespToCache(msgKey, r, backend, c.args.LazyCacheTTL, c.updatedKey.Add(1))
 	}
 	return err
 }
 
 // doLazyUpdate starts a new goroutine to execute next node and update the cache in the background.
-// It has an inner singleflight.Group to de-duplicate same msgKey.
+// It has an inner singleflight.Group to de-duplicate same msgKey. When the
+// backend is remote (Redis), the de-duplication lock itself is also taken
+// on the remote store (via SETNX) so that other mosdns instances sharing
+// that backend don't all refresh the same expired record at once.
 func (c *Cache) doLazyUpdate(msgKey string, qCtx *query_context.Context, next sequence.ChainWalker) {
 	qCtxCopy := qCtx.Copy()
 	var sf singleflight.Group
@@ -217,6 +330,18 @@ func (c *Cache) doLazyUpdate(msgKey string, qCtx *query_context.Context, next se
 	lazyUpdateFunc := func() (any, error) {
 		defer sf.Forget(msgKey)
 		qCtx := qCtxCopy
+		backend := c.getBackend()
+
+		if lockable, ok := backend.(LockableBackend); ok {
+			locked, unlock, err := lockable.TryLock(msgKey, defaultLazyUpdateTimeout)
+			if err != nil {
+				c.logger.Warn("failed to acquire remote lazy-update lock", qCtx.InfoField(), zap.Error(err))
+			} else if !locked {
+				return nil, nil // another instance is already refreshing this key.
+			} else {
+				defer unlock()
+			}
+		}
 
 		c.logger.Debug("start lazy cache update", qCtx.InfoField())
 		ctx, cancel := context.WithTimeout(context.Background(), defaultLazyUpdateTimeout)
@@ -229,8 +354,7 @@ func (c *Cache) doLazyUpdate(msgKey string, qCtx *query_context.Context, next se
 
 		r := qCtx.R()
 		if r != nil {
-			saveRespToCache(msgKey, r, c.backend, c.args.LazyCacheTTL)
-			c.updatedKey.Add(1)
+			saveRespToCache(msgKey, r, backend, c.args.LazyCacheTTL, c.updatedKey.Add(1))
 		}
 		c.logger.Debug("lazy cache updated", qCtx.InfoField())
 		return nil, nil
@@ -242,8 +366,131 @@ func (c *Cache) doLazyUpdate(msgKey string, qCtx *query_context.Context, next se
 }
 
 func getMsgKey(q *dns.Msg) string {
-	// 生成一个唯一的键，用于缓存查询
-	// 这里可以根据实际需求生成键，例如使用域名和类型
-	key := make([]byte, 16)
-	binary.BigEndian.PutUint64(key[:8], uint64(q.Id))
-	copy(key[8:], q
\ No newline at end of file
+	if len(q.Question) != 1 {
+		return ""
+	}
+	question := q.Question[0]
+
+	buf := make([]byte, 4+len(question.Name))
+	binary.BigEndian.PutUint16(buf[0:2], question.Qtype)
+	binary.BigEndian.PutUint16(buf[2:4], question.Qclass)
+	copy(buf[4:], strings.ToLower(question.Name)) // match case-insensitively.
+	return string(buf)
+}
+
+// getRespFromCache looks up msgKey and returns a deep copy of the cached
+// response, plus whether it was served from the lazy (already expired)
+// window.
+func getRespFromCache(msgKey string, backend Backend, lazyCacheEnabled bool, expiredMsgTtl uint32) (*dns.Msg, bool) {
+	v, remaining, ok := backend.Get(toKey(msgKey))
+	if !ok {
+		return nil, false
+	}
+
+	if remaining > 0 { // still fresh.
+		r := v.resp.Copy()
+		setRespTTL(r, remaining)
+		return r, false
+	}
+
+	if !lazyCacheEnabled {
+		return nil, false
+	}
+
+	// Expired, but lazy caching is on: serve the stale answer with a
+	// short ttl and let the caller kick off a background refresh.
+	r := v.resp.Copy()
+	setRespTTL(r, time.Duration(expiredMsgTtl)*time.Second)
+	return r, true
+}
+
+func saveRespToCache(msgKey string, r *dns.Msg, backend Backend, lazyCacheTTL int, seq uint64) {
+	if r.Rcode != dns.RcodeSuccess && r.Rcode != dns.RcodeNameError {
+		return // don't cache weird failures.
+	}
+
+	ttl := minimalTTL(r)
+	if ttl <= 0 {
+		return
+	}
+
+	storeTTL := ttl
+	if lazyCacheTTL > 0 {
+		storeTTL = time.Duration(lazyCacheTTL) * time.Second
+	}
+
+	backend.Set(toKey(msgKey), &item{resp: r.Copy(), ttl: ttl, seq: seq}, storeTTL)
+}
+
+// minimalTTL returns the smallest ttl across every record in r, which is
+// how long the whole answer can safely be cached for.
+func minimalTTL(r *dns.Msg) time.Duration {
+	var min uint32
+	has := false
+	for _, sec := range [][]dns.RR{r.Answer, r.Ns, r.Extra} {
+		for _, rr := range sec {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			ttl := rr.Header().Ttl
+			if !has || ttl < min {
+				min = ttl
+				has = true
+			}
+		}
+	}
+	if !has {
+		return 0
+	}
+	return time.Duration(min) * time.Second
+}
+
+func setRespTTL(r *dns.Msg, ttl time.Duration) {
+	s := uint32(ttl / time.Second)
+	for _, rr := range r.Answer {
+		rr.Header().Ttl = s
+	}
+	for _, rr := range r.Ns {
+		rr.Header().Ttl = s
+	}
+	for _, rr := range r.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			rr.Header().Ttl = s
+		}
+	}
+}
+
+func toKey(msgKey string) key {
+	return key(msgKey)
+}
+
+// Api exposes cache introspection endpoints.
+func (c *Cache) Api() *chi.Mux {
+	r := chi.NewRouter()
+	r.Get("/size", func(w http.ResponseWriter, req *http.Request) {
+		_, _ = io.WriteString(w, strconv.Itoa(c.getBackend().Len()))
+	})
+	r.Post("/flush", func(w http.ResponseWriter, req *http.Request) {
+		prev := c.swapBackend(newBackend(c.args, c.logger))
+		if err := prev.Close(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	return r
+}
+
+func (c *Cache) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		close(c.closeNotify)
+		if c.args.Redis == nil {
+			err = c.dumpNow()
+		}
+		if backendErr := c.getBackend().Close(); backendErr != nil && err == nil {
+			err = backendErr
+		}
+	})
+	return err
+}
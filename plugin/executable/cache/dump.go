@@ -0,0 +1,400 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"time"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+// Compressor tags stamped on every block so loadDump knows how to
+// inflate it regardless of what Args.DumpCompressor is set to today.
+const (
+	compressorGzip byte = iota
+	compressorZstd
+
+	compressorNameGzip = "gzip"
+	compressorNameZstd = "zstd"
+)
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+func compressorTagFor(name string) byte {
+	if name == compressorNameZstd {
+		return compressorZstd
+	}
+	return compressorGzip
+}
+
+func (c *Cache) startDumpLoop() {
+	go func() {
+		ticker := time.NewTicker(time.Duration(c.args.DumpInterval) * time.Second)
+		defer ticker.Stop()
+		var lastDumpAt uint64
+		for {
+			select {
+			case <-c.closeNotify:
+				return
+			case <-ticker.C:
+				if c.updatedKey.Load()-lastDumpAt < minimumChangesToDump {
+					continue
+				}
+				lastDumpAt = c.updatedKey.Load()
+				if err := c.dumpNow(); err != nil {
+					c.logger.Error("failed to dump cache", zap.Error(err))
+				}
+			}
+		}
+	}()
+}
+
+func (c *Cache) dumpPath() string { return c.args.DumpFile }
+
+// dumpNow writes live entries to DumpFile as a sequence of independent,
+// checksummed blocks (see writeDumpBlock). With Args.DumpIncremental it
+// appends only the entries stored since the last checkpoint instead of
+// re-serializing the whole cache.
+func (c *Cache) dumpNow() error {
+	if len(c.dumpPath()) == 0 {
+		return nil
+	}
+	mb, ok := c.getBackend().(*memBackend)
+	if !ok {
+		return nil // nothing sensible to dump for a remote backend.
+	}
+
+	start := time.Now()
+	defer func() { c.dumpDurationSeconds.Observe(time.Since(start).Seconds()) }()
+
+	incremental := c.args.DumpIncremental
+	checkpoint := c.lastDumpSeq.Load()
+	snapshot := c.updatedKey.Load()
+
+	flags := os.O_WRONLY | os.O_CREATE
+	writeHeader := true
+	if incremental {
+		flags |= os.O_APPEND
+		if fi, err := os.Stat(c.dumpPath()); err == nil && fi.Size() > 0 {
+			writeHeader = false
+		}
+	} else {
+		flags |= os.O_TRUNC
+		checkpoint = 0
+	}
+
+	f, err := os.OpenFile(c.dumpPath(), flags, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	cw := &countingWriter{w: f}
+	if writeHeader {
+		if _, err := cw.Write([]byte(dumpHeader)); err != nil {
+			return err
+		}
+	}
+
+	tag := compressorTagFor(c.args.DumpCompressor)
+	block := make([]dumpEntry, 0, dumpBlockSize)
+	flush := func() error {
+		if len(block) == 0 {
+			return nil
+		}
+		seq := c.dumpBlockSeq.Add(1)
+		return writeDumpBlock(cw, seq, block, tag)
+	}
+
+	var writeErr error
+	mb.walk(func(k key, v *item) bool {
+		if incremental && v.seq <= checkpoint {
+			return true
+		}
+		wire, err := v.resp.Pack()
+		if err != nil || len(wire) > dumpMaximumBlockLength {
+			return true
+		}
+		block = append(block, dumpEntry{key: k, ttl: v.ttl, seq: v.seq, wire: wire})
+		if len(block) >= dumpBlockSize {
+			if writeErr = flush(); writeErr != nil {
+				return false
+			}
+			block = block[:0]
+		}
+		return true
+	})
+	if writeErr == nil {
+		writeErr = flush()
+	}
+	c.dumpBytes.Add(float64(cw.n))
+	if writeErr != nil {
+		return writeErr
+	}
+	c.lastDumpSeq.Store(snapshot)
+	return nil
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+type dumpEntry struct {
+	key  key
+	ttl  time.Duration
+	seq  uint64
+	wire []byte
+}
+
+// writeDumpBlock encodes block as one compressed, checksummed unit:
+//
+//	uint32 blockLen (everything below this field)
+//	uint64 seq      (monotonic, per process, block sequence number)
+//	uint32 crc32c   (of the compressed payload)
+//	byte   compressor tag
+//	payload (compressed entries)
+//
+// The length prefix lets loadDump skip over the whole block, even a
+// corrupt one, without losing its place in the file.
+func writeDumpBlock(w io.Writer, seq uint64, block []dumpEntry, compressor byte) error {
+	var raw bytes.Buffer
+	if err := encodeDumpEntries(&raw, block); err != nil {
+		return err
+	}
+
+	payload, err := compressBlock(raw.Bytes(), compressor)
+	if err != nil {
+		return err
+	}
+	crc := crc32.Checksum(payload, crc32cTable)
+
+	var envelope bytes.Buffer
+	envelope.Grow(4 + 8 + 4 + 1 + len(payload))
+	_ = binary.Write(&envelope, binary.BigEndian, uint32(8+4+1+len(payload)))
+	_ = binary.Write(&envelope, binary.BigEndian, seq)
+	_ = binary.Write(&envelope, binary.BigEndian, crc)
+	envelope.WriteByte(compressor)
+	envelope.Write(payload)
+
+	_, err = w.Write(envelope.Bytes())
+	return err
+}
+
+func encodeDumpEntries(w io.Writer, block []dumpEntry) error {
+	var u16Buf [2]byte
+	var u32Buf [4]byte
+	for _, e := range block {
+		binary.BigEndian.PutUint16(u16Buf[:], uint16(len(e.key)))
+		if _, err := w.Write(u16Buf[:]); err != nil {
+			return err
+		}
+		if _, err := io.WriteString(w, string(e.key)); err != nil {
+			return err
+		}
+		if err := binary.Write(w, binary.BigEndian, int64(e.ttl)); err != nil {
+			return err
+		}
+		if err := binary.Write(w, binary.BigEndian, e.seq); err != nil {
+			return err
+		}
+		binary.BigEndian.PutUint32(u32Buf[:], uint32(len(e.wire)))
+		if _, err := w.Write(u32Buf[:]); err != nil {
+			return err
+		}
+		if _, err := w.Write(e.wire); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func compressBlock(raw []byte, tag byte) ([]byte, error) {
+	var buf bytes.Buffer
+	switch tag {
+	case compressorZstd:
+		zw, err := zstd.NewWriter(&buf)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := zw.Write(raw); err != nil {
+			zw.Close()
+			return nil, err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+	default:
+		gw := gzip.NewWriter(&buf)
+		if _, err := gw.Write(raw); err != nil {
+			gw.Close()
+			return nil, err
+		}
+		if err := gw.Close(); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+func decompressBlock(payload []byte, tag byte) ([]byte, error) {
+	switch tag {
+	case compressorZstd:
+		zr, err := zstd.NewReader(bytes.NewReader(payload))
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		return io.ReadAll(zr)
+	case compressorGzip:
+		gr, err := gzip.NewReader(bytes.NewReader(payload))
+		if err != nil {
+			return nil, err
+		}
+		defer gr.Close()
+		return io.ReadAll(gr)
+	default:
+		return nil, fmt.Errorf("unknown dump block compressor tag %d", tag)
+	}
+}
+
+// loadDump restores a dump file written by dumpNow. A block that fails
+// its crc32c check is skipped (its length prefix is still honored, so
+// the reader doesn't lose sync) rather than aborting the whole load.
+func (c *Cache) loadDump() error {
+	if len(c.dumpPath()) == 0 {
+		return nil
+	}
+	f, err := os.Open(c.dumpPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	header := make([]byte, len(dumpHeader))
+	if _, err := io.ReadFull(f, header); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		return err
+	}
+	if string(header) != dumpHeader {
+		return fmt.Errorf("unexpected dump header %q", header)
+	}
+
+	mb, ok := c.getBackend().(*memBackend)
+	if !ok {
+		return nil
+	}
+
+	var maxSeq uint64
+	var lenBuf [4]byte
+	for {
+		if _, err := io.ReadFull(f, lenBuf[:]); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return err
+		}
+		blockLen := binary.BigEndian.Uint32(lenBuf[:])
+		body := make([]byte, blockLen)
+		if _, err := io.ReadFull(f, body); err != nil {
+			return err // truncated block: nothing left worth salvaging.
+		}
+
+		if blockLen < 13 {
+			c.logger.Warn("skipping malformed cache dump block")
+			continue
+		}
+		seq := binary.BigEndian.Uint64(body[0:8])
+		crc := binary.BigEndian.Uint32(body[8:12])
+		tag := body[12]
+		payload := body[13:]
+
+		if crc32.Checksum(payload, crc32cTable) != crc {
+			c.logger.Warn("skipping corrupt cache dump block", zap.Uint64("seq", seq))
+			continue
+		}
+		raw, err := decompressBlock(payload, tag)
+		if err != nil {
+			c.logger.Warn("skipping unreadable cache dump block", zap.Uint64("seq", seq), zap.Error(err))
+			continue
+		}
+		entrySeq, err := decodeDumpEntries(raw, mb)
+		if err != nil {
+			c.logger.Warn("skipping unreadable cache dump block", zap.Uint64("seq", seq), zap.Error(err))
+			continue
+		}
+		if entrySeq > maxSeq {
+			maxSeq = entrySeq
+		}
+	}
+
+	if maxSeq > 0 {
+		c.updatedKey.Store(maxSeq)
+		c.lastDumpSeq.Store(maxSeq)
+	}
+	return nil
+}
+
+// decodeDumpEntries restores every entry in raw into mb and returns the
+// highest seq seen, so loadDump can resume the updatedKey/lastDumpSeq
+// counters where the dump left off.
+func decodeDumpEntries(raw []byte, mb *memBackend) (uint64, error) {
+	r := bytes.NewReader(raw)
+	var maxSeq uint64
+	var u16Buf [2]byte
+	var u32Buf [4]byte
+	for r.Len() > 0 {
+		if _, err := io.ReadFull(r, u16Buf[:]); err != nil {
+			return maxSeq, err
+		}
+		keyBuf := make([]byte, binary.BigEndian.Uint16(u16Buf[:]))
+		if _, err := io.ReadFull(r, keyBuf); err != nil {
+			return maxSeq, err
+		}
+		k := key(keyBuf)
+
+		var ttl int64
+		if err := binary.Read(r, binary.BigEndian, &ttl); err != nil {
+			return maxSeq, err
+		}
+		var seq uint64
+		if err := binary.Read(r, binary.BigEndian, &seq); err != nil {
+			return maxSeq, err
+		}
+		if _, err := io.ReadFull(r, u32Buf[:]); err != nil {
+			return maxSeq, err
+		}
+		wire := make([]byte, binary.BigEndian.Uint32(u32Buf[:]))
+		if _, err := io.ReadFull(r, wire); err != nil {
+			return maxSeq, err
+		}
+
+		msg := new(dns.Msg)
+		if err := msg.Unpack(wire); err != nil {
+			continue // skip corrupt entry, keep loading the rest of the block.
+		}
+		mb.restore(k, &item{resp: msg, ttl: time.Duration(ttl), seq: seq})
+		if seq > maxSeq {
+			maxSeq = seq
+		}
+	}
+	return maxSeq, nil
+}
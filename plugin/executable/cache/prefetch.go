@@ -0,0 +1,162 @@
+package cache
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultPrefetchTTLFraction = 0.1
+	defaultPrefetchConcurrency = 4
+
+	prefetchInterval = time.Second * 10
+	// prefetchEWMAAlpha weighs a fresh access against the running
+	// popularity score; prefetchTickDecay cools it back down on ticks
+	// where the key wasn't queried, the same shape fallback's upstream
+	// EWMA uses for rtt/fail sampling.
+	prefetchEWMAAlpha = 0.3
+	prefetchTickDecay = 0.9
+)
+
+// popRecord tracks how often a key is queried and how to replay the
+// query if it turns out to be worth prefetching.
+type popRecord struct {
+	ewma float64
+	next sequence.ChainWalker
+}
+
+// recordAccess bumps msgKey's popularity score and remembers the chain
+// position needed to refresh it later, independent of whether this
+// particular query was a cache hit or miss.
+func (c *Cache) recordAccess(k key, next sequence.ChainWalker) {
+	c.popMu.Lock()
+	defer c.popMu.Unlock()
+
+	p, ok := c.popularity[k]
+	if !ok {
+		p = &popRecord{}
+		c.popularity[k] = p
+	}
+	p.ewma += prefetchEWMAAlpha * (1 - p.ewma)
+	p.next = next
+}
+
+func (c *Cache) startPrefetchLoop() {
+	go func() {
+		ticker := time.NewTicker(prefetchInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-c.closeNotify:
+				return
+			case <-ticker.C:
+				c.runPrefetchTick()
+			}
+		}
+	}()
+}
+
+// runPrefetchTick decays every tracked key's popularity, drops keys that
+// are no longer cached, and starts a refresh for every key that remains
+// popular and close to expiry (see Args.PrefetchConcurrency).
+func (c *Cache) runPrefetchTick() {
+	type candidate struct {
+		k    key
+		ewma float64
+		next sequence.ChainWalker
+	}
+
+	// Decay and snapshot under popMu, then release it before the
+	// per-key backend.Get calls below: for a Redis backend each Get is a
+	// network round trip, and holding popMu through the whole sweep
+	// would block recordAccess (and so every query) for the tick's
+	// entire duration.
+	c.popMu.Lock()
+	snapshot := make([]candidate, 0, len(c.popularity))
+	for k, p := range c.popularity {
+		p.ewma *= prefetchTickDecay
+		snapshot = append(snapshot, candidate{k: k, ewma: p.ewma, next: p.next})
+	}
+	c.popMu.Unlock()
+
+	type due struct {
+		k    key
+		next sequence.ChainWalker
+	}
+	var toRefresh []due
+	var gone []key
+
+	for _, cand := range snapshot {
+		v, remaining, ok := c.getBackend().Get(cand.k)
+		if !ok {
+			gone = append(gone, cand.k)
+			continue
+		}
+		if cand.ewma < c.args.PrefetchThreshold {
+			continue
+		}
+		if v.ttl <= 0 || float64(remaining)/float64(v.ttl) > c.args.PrefetchTTLFraction {
+			continue
+		}
+		toRefresh = append(toRefresh, due{k: cand.k, next: cand.next})
+	}
+
+	if len(gone) > 0 {
+		c.popMu.Lock()
+		for _, k := range gone {
+			delete(c.popularity, k)
+		}
+		c.popMu.Unlock()
+	}
+
+	if len(toRefresh) == 0 {
+		return
+	}
+
+	sem := make(chan struct{}, c.args.PrefetchConcurrency)
+	for _, d := range toRefresh {
+		sem <- struct{}{}
+		go func(d due) {
+			defer func() { <-sem }()
+			c.prefetchOne(d.k, d.next)
+		}(d)
+	}
+}
+
+// prefetchOne replays key k through the chain it was last seen on,
+// reusing doLazyUpdate so the refresh is de-duplicated (and, for a
+// remote backend, remote-locked) against any concurrent lazy-cache
+// refresh a real client's query might have just triggered.
+func (c *Cache) prefetchOne(k key, next sequence.ChainWalker) {
+	qname, qtype, qclass, ok := parseMsgKey(k)
+	if !ok {
+		return
+	}
+
+	q := new(dns.Msg)
+	q.SetQuestion(qname, qtype)
+	q.Question[0].Qclass = qclass
+	qCtx := query_context.NewContext(q, nil)
+
+	c.logger.Debug("prefetching popular record", zap.String("qname", qname))
+	c.prefetchTotal.Inc()
+	c.doLazyUpdate(string(k), qCtx, next)
+}
+
+// parseMsgKey reverses getMsgKey's encoding (qtype uint16, qclass
+// uint16, lowercased fqdn name).
+func parseMsgKey(k key) (qname string, qtype, qclass uint16, ok bool) {
+	b := []byte(k)
+	if len(b) < 4 {
+		return "", 0, 0, false
+	}
+	qtype = binary.BigEndian.Uint16(b[0:2])
+	qclass = binary.BigEndian.Uint16(b[2:4])
+	qname = string(b[4:])
+	return qname, qtype, qclass, true
+}
@@ -0,0 +1,269 @@
+// Package fake_ip implements a fake-IP DNS plugin.
+//
+// It intercepts A/AAAA queries that match a configured domain set and
+// answers them with a synthesized address allocated from a private CIDR
+// pool, keeping a bidirectional domain<->IP mapping so that a downstream
+// TUN/redirect layer can recover the original domain name from the
+// fake address on outbound traffic. This is the same trick used by
+// clash/mihomo's "fake-ip" mode.
+package fake_ip
+
+import (
+	"context"
+	"encoding/gob"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"net/netip"
+	"os"
+	"sync"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/matcher/domain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
+	"github.com/IrineSistiana/mosdns/v5/plugin/data_provider/domain_set"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/go-chi/chi/v5"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+const PluginType = "fake_ip"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() any { return new(Args) })
+}
+
+const (
+	defaultTTL        = 1 // Seconds. Fake responses must have a short ttl.
+	defaultShardCount = 64
+)
+
+var _ sequence.RecursiveExecutable = (*FakeIP)(nil)
+
+type Args struct {
+	IPv4 string `yaml:"ipv4"` // Required. e.g. "198.18.0.0/15".
+	IPv6 string `yaml:"ipv6"` // Optional. If empty, AAAA queries get NODATA.
+
+	Domains     []string `yaml:"domains"`
+	SkipDomains []string `yaml:"skip_domains"`
+	Files       []string `yaml:"files"`
+
+	TTL  int `yaml:"ttl"`  // Default is 1.
+	Size int `yaml:"size"` // Max live entries. Default is 64*1024.
+
+	DumpFile string `yaml:"dump_file"`
+}
+
+func (a *Args) init() {
+	utils.SetDefaultUnsignNum(&a.TTL, defaultTTL)
+	utils.SetDefaultUnsignNum(&a.Size, 64*1024)
+}
+
+type FakeIP struct {
+	args   *Args
+	logger *zap.Logger
+
+	domains *domain.MixMatcher[struct{}]
+	skip    *domain.MixMatcher[struct{}]
+
+	store *Store
+
+	closeOnce sync.Once
+}
+
+func Init(bp *coremain.BP, args any) (any, error) {
+	f, err := NewFakeIP(args.(*Args), Opts{Logger: bp.L()})
+	if err != nil {
+		return nil, err
+	}
+	bp.RegAPI(f.Api())
+	return f, nil
+}
+
+type Opts struct {
+	Logger *zap.Logger
+}
+
+func NewFakeIP(args *Args, opts Opts) (*FakeIP, error) {
+	args.init()
+	if len(args.IPv4) == 0 {
+		return nil, fmt.Errorf("args: ipv4 pool is required")
+	}
+
+	logger := opts.Logger
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+
+	v4Pool, err := newPool(args.IPv4)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ipv4 pool, %w", err)
+	}
+	if !looksLikeRecommendedRange(v4Pool.prefix) {
+		logger.Warn(
+			"fake-ip ipv4 pool is outside the recommended RFC 6598 / RFC 5737 ranges, it may collide with real addresses",
+			zap.String("ipv4", args.IPv4),
+		)
+	}
+	var v6Pool *pool
+	if len(args.IPv6) > 0 {
+		v6Pool, err = newPool(args.IPv6)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ipv6 pool, %w", err)
+		}
+	}
+
+	dm := domain.NewDomainMixMatcher()
+	if err := domain_set.LoadExpsAndFiles(args.Domains, args.Files, dm); err != nil {
+		return nil, fmt.Errorf("failed to load domains, %w", err)
+	}
+
+	skip := domain.NewDomainMixMatcher()
+	if err := domain_set.LoadExpsAndFiles(args.SkipDomains, nil, skip); err != nil {
+		return nil, fmt.Errorf("failed to load skip_domains, %w", err)
+	}
+
+	f := &FakeIP{
+		args:    args,
+		logger:  logger,
+		domains: dm,
+		skip:    skip,
+		store:   newStore(v4Pool, v6Pool, args.Size),
+	}
+
+	if len(args.DumpFile) > 0 {
+		if err := f.loadDump(); err != nil {
+			logger.Warn("failed to load fake-ip dump", zap.Error(err))
+		}
+	}
+	return f, nil
+}
+
+func (f *FakeIP) Exec(ctx context.Context, qCtx *query_context.Context, next sequence.ChainWalker) error {
+	q := qCtx.Q()
+	if len(q.Question) != 1 || q.Question[0].Qclass != dns.ClassINET {
+		return next.ExecNext(ctx, qCtx)
+	}
+
+	question := q.Question[0]
+	qtype := question.Qtype
+	if qtype != dns.TypeA && qtype != dns.TypeAAAA {
+		return next.ExecNext(ctx, qCtx)
+	}
+
+	qname := question.Name
+	if _, ok := f.skip.Match(qname); ok {
+		return next.ExecNext(ctx, qCtx)
+	}
+	if _, ok := f.domains.Match(qname); !ok {
+		return next.ExecNext(ctx, qCtx)
+	}
+
+	r := new(dns.Msg)
+	r.SetReply(q)
+	r.RecursionAvailable = true
+	r.Authoritative = false
+
+	switch qtype {
+	case dns.TypeA:
+		addr, err := f.store.allocate(qname, false)
+		if err != nil {
+			f.logger.Warn("fake-ip pool exhausted", zap.String("domain", qname), zap.Error(err))
+			qCtx.SetResponse(r) // empty answer; r is shared, so the SERVFAIL rcode set below applies.
+			r.Rcode = dns.RcodeServerFailure
+			return nil
+		}
+		rr := &dns.A{
+			Hdr: dns.RR_Header{Name: qname, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: uint32(f.args.TTL)},
+			A:   addr.AsSlice(),
+		}
+		r.Answer = append(r.Answer, rr)
+	case dns.TypeAAAA:
+		if f.store.v6 == nil {
+			// No v6 pool configured. Return NODATA so clients fall back to A.
+			qCtx.SetResponse(r)
+			return nil
+		}
+		addr, err := f.store.allocate(qname, true)
+		if err != nil {
+			f.logger.Warn("fake-ip pool exhausted", zap.String("domain", qname), zap.Error(err))
+			r.Rcode = dns.RcodeServerFailure
+			qCtx.SetResponse(r)
+			return nil
+		}
+		rr := &dns.AAAA{
+			Hdr:  dns.RR_Header{Name: qname, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: uint32(f.args.TTL)},
+			AAAA: addr.AsSlice(),
+		}
+		r.Answer = append(r.Answer, rr)
+	}
+
+	qCtx.SetResponse(r)
+	return nil
+}
+
+// DomainOf returns the domain previously allocated to addr, if any.
+func (f *FakeIP) DomainOf(addr netip.Addr) (string, bool) {
+	return f.store.domainOf(addr)
+}
+
+// Api returns the admin endpoints for inspecting and flushing the fake-ip table.
+func (f *FakeIP) Api() *chi.Mux {
+	r := chi.NewRouter()
+	r.Get("/dump", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = f.store.dumpJSON(w)
+	})
+	r.Post("/flush", func(w http.ResponseWriter, req *http.Request) {
+		f.store.flush()
+		w.WriteHeader(http.StatusNoContent)
+	})
+	return r
+}
+
+// Close persists the store to disk, if configured.
+func (f *FakeIP) Close() error {
+	var err error
+	f.closeOnce.Do(func() {
+		if len(f.args.DumpFile) > 0 {
+			err = f.saveDump()
+		}
+	})
+	return err
+}
+
+func (f *FakeIP) dumpPath() string { return f.args.DumpFile }
+
+func (f *FakeIP) saveDump() error {
+	file, err := os.Create(f.dumpPath())
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return gob.NewEncoder(file).Encode(f.store.snapshot())
+}
+
+func (f *FakeIP) loadDump() error {
+	file, err := os.Open(f.dumpPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer file.Close()
+	var records []record
+	if err := gob.NewDecoder(file).Decode(&records); err != nil {
+		return err
+	}
+	f.store.restore(records)
+	return nil
+}
+
+func shardIndex(domain string, n int) int {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(domain))
+	return int(h.Sum32()) % n
+}
@@ -0,0 +1,143 @@
+package fake_ip
+
+import (
+	"errors"
+	"net/netip"
+	"sync"
+)
+
+// pool hands out addresses from a CIDR range. The network address, the
+// broadcast address (v4 only) and the first reservedHosts addresses
+// (commonly used as gateway/DNS by the host network stack) are never
+// allocated.
+//
+// A pool is shared by every shard of the Store that owns it (all
+// domains hashing to the same address family draw from the same v4/v6
+// pool), so it has its own mutex independent of the caller's shard
+// lock.
+type pool struct {
+	mu sync.Mutex
+
+	prefix netip.Prefix
+	base   netip.Addr // first allocatable address
+	count  uint64     // number of allocatable addresses
+
+	next  netip.Addr // next address to try, wraps back to base
+	taken map[netip.Addr]struct{}
+	free  []netip.Addr // reclaimed addresses, reused before advancing next
+}
+
+const reservedHosts = 2 // reserve .0 (net) + .1 (gateway), and for v4 also skip broadcast below.
+
+var ErrPoolExhausted = errors.New("fake-ip pool exhausted")
+
+// recommendedFakeIPRanges are the v4 ranges that are safe to reuse as a
+// fake-ip pool without colliding with addresses a client might actually
+// want to reach: RFC 6598 shared address space and the RFC 5737
+// documentation ranges, neither of which is supposed to appear in real
+// traffic. clash's default 198.18.0.0/15 (the RFC 2544 benchmarking
+// range) is not in this list.
+var recommendedFakeIPRanges = []netip.Prefix{
+	netip.MustParsePrefix("100.64.0.0/10"),   // RFC 6598 shared address space
+	netip.MustParsePrefix("192.0.2.0/24"),    // RFC 5737 TEST-NET-1
+	netip.MustParsePrefix("198.51.100.0/24"), // RFC 5737 TEST-NET-2
+	netip.MustParsePrefix("203.0.113.0/24"),  // RFC 5737 TEST-NET-3
+}
+
+// looksLikeRecommendedRange reports whether prefix falls entirely within
+// one of recommendedFakeIPRanges. It only applies to v4; v6 pools are
+// left unchecked since there is no equivalent narrow convention.
+func looksLikeRecommendedRange(prefix netip.Prefix) bool {
+	if !prefix.Addr().Is4() {
+		return true
+	}
+	for _, r := range recommendedFakeIPRanges {
+		if r.Contains(prefix.Addr()) && r.Bits() <= prefix.Bits() {
+			return true
+		}
+	}
+	return false
+}
+
+func newPool(cidr string) (*pool, error) {
+	prefix, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		return nil, err
+	}
+	prefix = prefix.Masked()
+
+	bits := prefix.Addr().BitLen() - prefix.Bits()
+	if bits < 2 {
+		return nil, errors.New("pool is too small")
+	}
+	total := uint64(1) << uint(bits)
+	reserved := uint64(reservedHosts)
+	if prefix.Addr().Is4() {
+		reserved++ // also reserve the broadcast address
+	}
+	if total <= reserved {
+		return nil, errors.New("pool is too small")
+	}
+
+	base := prefix.Addr()
+	for i := uint64(0); i < reservedHosts; i++ {
+		base = base.Next()
+	}
+
+	return &pool{
+		prefix: prefix,
+		base:   base,
+		count:  total - reserved,
+		next:   base,
+		taken:  make(map[netip.Addr]struct{}),
+	}, nil
+}
+
+// allocate returns an unused address from the pool.
+func (p *pool) allocate() (netip.Addr, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.free) > 0 {
+		addr := p.free[len(p.free)-1]
+		p.free = p.free[:len(p.free)-1]
+		p.taken[addr] = struct{}{}
+		return addr, nil
+	}
+
+	for i := uint64(0); i < p.count; i++ {
+		addr := p.next
+		p.next = p.next.Next()
+		isBroadcast := p.prefix.Addr().Is4() && !p.prefix.Contains(p.next.Next())
+		if !p.prefix.Contains(p.next) || p.next == p.prefix.Addr() || isBroadcast {
+			p.next = p.base
+		}
+		if _, used := p.taken[addr]; !used {
+			p.taken[addr] = struct{}{}
+			return addr, nil
+		}
+	}
+	return netip.Addr{}, ErrPoolExhausted
+}
+
+func (p *pool) release(addr netip.Addr) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.taken, addr)
+	p.free = append(p.free, addr)
+}
+
+func (p *pool) reserve(addr netip.Addr) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.taken[addr] = struct{}{}
+}
+
+// reset clears the pool's allocation state, e.g. for Store.flush.
+func (p *pool) reset() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.taken = make(map[netip.Addr]struct{})
+	p.free = nil
+	p.next = p.base
+}
@@ -0,0 +1,50 @@
+package fake_ip
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestPoolAllocateReleaseRoundTrip(t *testing.T) {
+	p, err := newPool("198.18.0.0/30")
+	if err != nil {
+		t.Fatalf("newPool: %v", err)
+	}
+
+	// /30 has 4 addresses, minus 2 reserved (net+gateway) and 1 broadcast
+	// leaves exactly 1 allocatable address.
+	addr, err := p.allocate()
+	if err != nil {
+		t.Fatalf("allocate: %v", err)
+	}
+	if _, err := p.allocate(); err != ErrPoolExhausted {
+		t.Fatalf("allocate on exhausted pool = %v, want ErrPoolExhausted", err)
+	}
+
+	p.release(addr)
+	got, err := p.allocate()
+	if err != nil {
+		t.Fatalf("allocate after release: %v", err)
+	}
+	if got != addr {
+		t.Errorf("allocate after release = %v, want reclaimed %v", got, addr)
+	}
+}
+
+func TestLooksLikeRecommendedRange(t *testing.T) {
+	cases := []struct {
+		cidr string
+		want bool
+	}{
+		{"100.64.0.0/16", true},  // inside RFC 6598 shared address space
+		{"192.0.2.0/24", true},   // RFC 5737 TEST-NET-1
+		{"10.0.0.0/24", false},   // RFC 1918 private space, not a recommended fake-ip range
+		{"198.18.0.0/15", false}, // RFC 2544 benchmarking range, not in our recommended list
+	}
+	for _, c := range cases {
+		prefix := netip.MustParsePrefix(c.cidr)
+		if got := looksLikeRecommendedRange(prefix); got != c.want {
+			t.Errorf("looksLikeRecommendedRange(%s) = %v, want %v", c.cidr, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package fake_ip
+
+import (
+	"container/list"
+	"encoding/json"
+	"io"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// Store is the bidirectional domain<->fake-IP table. It is sharded by
+// the domain name's hash so that concurrent Exec calls from different
+// query workers rarely contend on the same lock.
+type Store struct {
+	v4 *pool
+	v6 *pool
+
+	shards [defaultShardCount]*shard
+}
+
+type shard struct {
+	mu sync.Mutex
+	// domainToIP is keyed by (domain, address family): a domain resolved
+	// for both A and AAAA gets two independent mappings instead of the
+	// second overwriting the first, which used to orphan the first
+	// mapping's pool address and ipToDomain entry.
+	domainToIP map[domainKey]*mapping
+	ipToDomain map[netip.Addr]string
+	lru        *list.List // of *mapping, most-recently-used at the front
+	cap        int
+}
+
+type domainKey struct {
+	domain string
+	v6     bool
+}
+
+type mapping struct {
+	domain  string
+	v6      bool
+	addr    netip.Addr
+	expires time.Time
+	elem    *list.Element
+}
+
+func (m *mapping) key() domainKey { return domainKey{domain: m.domain, v6: m.v6} }
+
+// record is the persisted form of a mapping, used by gob/json encoding.
+type record struct {
+	Domain  string
+	Addr    netip.Addr
+	Expires time.Time
+}
+
+func newStore(v4, v6 *pool, size int) *Store {
+	s := &Store{v4: v4, v6: v6}
+	perShard := size / defaultShardCount
+	if perShard < 16 {
+		perShard = 16
+	}
+	for i := range s.shards {
+		s.shards[i] = &shard{
+			domainToIP: make(map[domainKey]*mapping),
+			ipToDomain: make(map[netip.Addr]string),
+			lru:        list.New(),
+			cap:        perShard,
+		}
+	}
+	return s
+}
+
+func (s *Store) shardFor(domain string) *shard {
+	return s.shards[shardIndex(domain, len(s.shards))]
+}
+
+// allocate returns the fake IP for domain, reusing a live mapping if one
+// already exists, or allocating a fresh one from the relevant pool.
+func (s *Store) allocate(domain string, v6 bool) (netip.Addr, error) {
+	sh := s.shardFor(domain)
+	p := s.v4
+	if v6 {
+		p = s.v6
+	}
+
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	dk := domainKey{domain: domain, v6: v6}
+	if m, ok := sh.domainToIP[dk]; ok {
+		m.expires = time.Now().Add(defaultMappingTTL)
+		sh.lru.MoveToFront(m.elem)
+		return m.addr, nil
+	}
+
+	addr, err := p.allocate()
+	if err != nil {
+		sh.evictIdle(p)
+		addr, err = p.allocate()
+		if err != nil {
+			return netip.Addr{}, err
+		}
+	}
+
+	m := &mapping{domain: domain, v6: v6, addr: addr, expires: time.Now().Add(defaultMappingTTL)}
+	m.elem = sh.lru.PushFront(m)
+	sh.domainToIP[dk] = m
+	sh.ipToDomain[addr] = domain
+
+	if sh.lru.Len() > sh.cap {
+		sh.evictOldest(p)
+	}
+	return addr, nil
+}
+
+const defaultMappingTTL = 24 * time.Hour
+
+// evictIdle drops the least-recently-used entry that has not been
+// refreshed in a while, returning the freed address to its pool.
+func (s *shard) evictIdle(p *pool) {
+	elem := s.lru.Back()
+	if elem == nil {
+		return
+	}
+	m := elem.Value.(*mapping)
+	if time.Now().Before(m.expires) {
+		return // still live, caller will get ErrPoolExhausted instead of evicting active entries
+	}
+	s.removeLocked(m, p)
+}
+
+func (s *shard) evictOldest(p *pool) {
+	elem := s.lru.Back()
+	if elem == nil {
+		return
+	}
+	s.removeLocked(elem.Value.(*mapping), p)
+}
+
+func (s *shard) removeLocked(m *mapping, p *pool) {
+	s.lru.Remove(m.elem)
+	delete(s.domainToIP, m.key())
+	delete(s.ipToDomain, m.addr)
+	p.release(m.addr)
+}
+
+// domainOf implements FakeIP.DomainOf.
+func (s *Store) domainOf(addr netip.Addr) (string, bool) {
+	for _, sh := range s.shards {
+		sh.mu.Lock()
+		d, ok := sh.ipToDomain[addr]
+		sh.mu.Unlock()
+		if ok {
+			return d, true
+		}
+	}
+	return "", false
+}
+
+func (s *Store) flush() {
+	for _, sh := range s.shards {
+		sh.mu.Lock()
+		sh.domainToIP = make(map[domainKey]*mapping)
+		sh.ipToDomain = make(map[netip.Addr]string)
+		sh.lru.Init()
+		sh.mu.Unlock()
+	}
+	for _, p := range []*pool{s.v4, s.v6} {
+		if p == nil {
+			continue
+		}
+		p.reset()
+	}
+}
+
+func (s *Store) dumpJSON(w io.Writer) error {
+	return json.NewEncoder(w).Encode(s.snapshot())
+}
+
+func (s *Store) snapshot() []record {
+	var out []record
+	for _, sh := range s.shards {
+		sh.mu.Lock()
+		for _, m := range sh.domainToIP {
+			out = append(out, record{Domain: m.domain, Addr: m.addr, Expires: m.expires})
+		}
+		sh.mu.Unlock()
+	}
+	return out
+}
+
+// restore reloads a persisted table. Expired entries are skipped; live
+// ones are re-inserted and their addresses marked as taken in the pool
+// so they are never handed out to a different domain.
+func (s *Store) restore(records []record) {
+	now := time.Now()
+	for _, rec := range records {
+		if rec.Expires.Before(now) {
+			continue
+		}
+		p := s.v4
+		if rec.Addr.Is6() {
+			p = s.v6
+		}
+		if p == nil {
+			continue
+		}
+		sh := s.shardFor(rec.Domain)
+		sh.mu.Lock()
+		p.reserve(rec.Addr)
+		m := &mapping{domain: rec.Domain, v6: rec.Addr.Is6(), addr: rec.Addr, expires: rec.Expires}
+		m.elem = sh.lru.PushFront(m)
+		sh.domainToIP[m.key()] = m
+		sh.ipToDomain[rec.Addr] = rec.Domain
+		sh.mu.Unlock()
+	}
+}
@@ -2,19 +2,22 @@ package redirect
 
 import (
 	"bytes"
+	"container/list"
 	"context"
 	"fmt"
 	"os"
 	"strings"
 	"sync"
-	"sync/atomic"
 	"time"
 
 	"github.com/IrineSistiana/mosdns/v5/coremain"
 	"github.com/IrineSistiana/mosdns/v5/pkg/matcher/domain"
 	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
 	"github.com/miekg/dns"
-	"go.ubuntu.com/zap"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
 )
 
 const PluginType = "redirect"
@@ -25,28 +28,76 @@ func init() {
 
 var _ sequence.RecursiveExecutable = (*Redirect)(nil)
 
+const (
+	defaultCacheSize        = 1024
+	defaultCacheTTL         = 5 * 60 // 5 min, in seconds.
+	defaultNegativeCacheTTL = 60     // 1 min, in seconds.
+	janitorInterval         = time.Second * 10
+)
+
 type Args struct {
 	Rules []string `yaml:"rules"`
 	Files []string `yaml:"files"`
+
+	// CacheSize is the max number of entries (positive and negative
+	// combined) kept in the LRU. Default 1024.
+	CacheSize int `yaml:"cache_size"`
+	// CacheTTL is how long a matched redirect is cached for, in
+	// seconds. Default 300.
+	CacheTTL int `yaml:"cache_ttl"`
+	// NegativeCacheTTL is how long a "no match" result is cached for,
+	// in seconds, so repeated misses skip the matcher entirely.
+	// Default 60.
+	NegativeCacheTTL int `yaml:"negative_cache_ttl"`
+}
+
+func (a *Args) init() {
+	utils.SetDefaultUnsignNum(&a.CacheSize, defaultCacheSize)
+	utils.SetDefaultUnsignNum(&a.CacheTTL, defaultCacheTTL)
+	utils.SetDefaultUnsignNum(&a.NegativeCacheTTL, defaultNegativeCacheTTL)
+}
+
+type Opts struct {
+	Logger     *zap.Logger
+	MetricsTag string
 }
 
 type Redirect struct {
-	m           *domain.MixMatcher[string]
-	cache       map[string]string
-	cacheExpire time.Duration
-	cacheMutex  sync.RWMutex
+	m     *domain.MixMatcher[string]
+	cache *redirectCache
+
+	logger      *zap.Logger
+	closeOnce   sync.Once
+	closeNotify chan struct{}
+
+	queryTotal       prometheus.Counter
+	hitTotal         prometheus.Counter
+	negativeHitTotal prometheus.Counter
 }
 
 func Init(bp *coremain.BP, args any) (any, error) {
-	r, err := NewRedirect(args.(*Args))
+	r, err := NewRedirect(args.(*Args), Opts{
+		Logger:     bp.L(),
+		MetricsTag: bp.Tag(),
+	})
 	if err != nil {
 		return nil, err
 	}
+	if err := r.RegMetricsTo(prometheus.WrapRegistererWithPrefix(PluginType+"_", bp.M().GetMetricsReg())); err != nil {
+		return nil, fmt.Errorf("failed to register metrics, %w", err)
+	}
 	bp.L().Info("redirect rules loaded", zap.Int("length", r.Len()))
 	return r, nil
 }
 
-func NewRedirect(args *Args) (*Redirect, error) {
+func NewRedirect(args *Args, opts Opts) (*Redirect, error) {
+	args.init()
+
+	logger := opts.Logger
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+
 	parseFunc := func(s string) (p, v string, err error) {
 		f := strings.Fields(s)
 		if len(f) != 2 {
@@ -104,29 +155,67 @@ func NewRedirect(args *Args) (*Redirect, error) {
 		return nil, err
 	}
 
-	return &Redirect{
-		m:           m,
-		cache:       make(map[string]string),
-		cacheExpire: 5 * time.Minute,
-	}, nil
+	lb := map[string]string{"tag": opts.MetricsTag}
+	r := &Redirect{
+		m: m,
+		cache: newRedirectCache(
+			args.CacheSize,
+			time.Duration(args.CacheTTL)*time.Second,
+			time.Duration(args.NegativeCacheTTL)*time.Second,
+		),
+		logger:      logger,
+		closeNotify: make(chan struct{}),
+
+		queryTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "query_total",
+			Help:        "The total number of processed queries",
+			ConstLabels: lb,
+		}),
+		hitTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "hit_total",
+			Help:        "The total number of queries that hit a cached redirect",
+			ConstLabels: lb,
+		}),
+		negativeHitTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "negative_hit_total",
+			Help:        "The total number of queries that hit a cached no-match result",
+			ConstLabels: lb,
+		}),
+	}
+	r.startJanitor()
+	return r, nil
+}
+
+func (r *Redirect) RegMetricsTo(reg prometheus.Registerer) error {
+	for _, collector := range [...]prometheus.Collector{r.queryTotal, r.hitTotal, r.negativeHitTotal} {
+		if err := reg.Register(collector); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (r *Redirect) Exec(ctx context.Context, qCtx *query_context.Context, next sequence.ChainWalker) error {
+	r.queryTotal.Inc()
 	q := qCtx.Q()
 	if len(q.Question) != 1 || q.Question[0].Qclass != dns.ClassINET {
 		return next.ExecNext(ctx, qCtx)
 	}
 
 	orgQName := q.Question[0].Name
-	redirectTarget, ok := r.getCache(orgQName)
-	if !ok {
-		redirectTarget, ok = r.m.Match(orgQName)
-		if ok {
-			r.setCache(orgQName, redirectTarget)
+	redirectTarget, matched, cached := r.cache.get(orgQName)
+	if cached {
+		if matched {
+			r.hitTotal.Inc()
+		} else {
+			r.negativeHitTotal.Inc()
 		}
+	} else {
+		redirectTarget, matched = r.m.Match(orgQName)
+		r.cache.set(orgQName, redirectTarget, matched)
 	}
 
-	if !ok {
+	if !matched {
 		return next.ExecNext(ctx, qCtx)
 	}
 
@@ -165,23 +254,116 @@ func (r *Redirect) Len() int {
 	return r.m.Len()
 }
 
-func (r *Redirect) getCache(key string) (string, bool) {
-	r.cacheMutex.RLock()
-	defer r.cacheMutex.RUnlock()
-
-	target, ok := r.cache[key]
-	return target, ok
+func (r *Redirect) Close() error {
+	r.closeOnce.Do(func() { close(r.closeNotify) })
+	return nil
 }
 
-func (r *Redirect) setCache(key, value string) {
-	r.cacheMutex.Lock()
-	defer r.cacheMutex.Unlock()
-
-	r.cache[key] = value
+func (r *Redirect) startJanitor() {
 	go func() {
-		time.Sleep(r.cacheExpire)
-		r.cacheMutex.Lock()
-		delete(r.cache, key)
-		r.cacheMutex.Unlock()
+		ticker := time.NewTicker(janitorInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-r.closeNotify:
+				return
+			case <-ticker.C:
+				r.cache.evictExpired()
+			}
+		}
 	}()
-}
\ No newline at end of file
+}
+
+// redirectCache is a bounded LRU of both positive (matched) and negative
+// (no-match) results, keyed by query name. A single janitor goroutine
+// (Redirect.startJanitor) sweeps it on a ticker instead of each entry
+// spawning its own expiry timer, so goroutine count no longer scales
+// with query rate.
+type redirectCache struct {
+	mu          sync.Mutex
+	cap         int
+	ttl         time.Duration
+	negativeTTL time.Duration
+
+	entries map[string]*list.Element
+	order   *list.List // of *cacheEntry, most-recently-used at the front.
+}
+
+type cacheEntry struct {
+	key     string
+	target  string
+	matched bool
+	expires time.Time
+}
+
+func newRedirectCache(cap int, ttl, negativeTTL time.Duration) *redirectCache {
+	return &redirectCache{
+		cap:         cap,
+		ttl:         ttl,
+		negativeTTL: negativeTTL,
+		entries:     make(map[string]*list.Element, cap),
+		order:       list.New(),
+	}
+}
+
+// get returns the cached target and whether it was a match, plus whether
+// a live (non-expired) entry was found at all.
+func (c *redirectCache) get(name string) (target string, matched bool, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[name]
+	if !ok {
+		return "", false, false
+	}
+	e := elem.Value.(*cacheEntry)
+	if time.Now().After(e.expires) {
+		c.removeLocked(elem)
+		return "", false, false
+	}
+	c.order.MoveToFront(elem)
+	return e.target, e.matched, true
+}
+
+func (c *redirectCache) set(name, target string, matched bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ttl := c.ttl
+	if !matched {
+		ttl = c.negativeTTL
+	}
+	e := &cacheEntry{key: name, target: target, matched: matched, expires: time.Now().Add(ttl)}
+
+	if elem, ok := c.entries[name]; ok {
+		elem.Value = e
+		c.order.MoveToFront(elem)
+		return
+	}
+
+	elem := c.order.PushFront(e)
+	c.entries[name] = elem
+	if c.order.Len() > c.cap {
+		c.removeLocked(c.order.Back())
+	}
+}
+
+func (c *redirectCache) evictExpired() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	for elem := c.order.Back(); elem != nil; {
+		prev := elem.Prev()
+		if now.After(elem.Value.(*cacheEntry).expires) {
+			c.removeLocked(elem)
+		}
+		elem = prev
+	}
+}
+
+// removeLocked must be called with c.mu held.
+func (c *redirectCache) removeLocked(elem *list.Element) {
+	c.order.Remove(elem)
+	delete(c.entries, elem.Value.(*cacheEntry).key)
+}
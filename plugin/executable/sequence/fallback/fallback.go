@@ -2,17 +2,22 @@ package fallback
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/IrineSistiana/mosdns/v5/coremain"
-	"github.com/IrineSistiana/mosdns/v5/pkg/pool"
 	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
 	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/go-chi/chi/v5"
 	"github.com/miekg/dns"
 	"go.uber.org/zap"
-	"sync"
 )
 
 const PluginType = "fallback"
@@ -20,62 +25,169 @@ const PluginType = "fallback"
 const (
 	defaultParallelTimeout   = time.Second * 5
 	defaultFallbackThreshold = time.Millisecond * 500
+
+	// ewmaAlpha weighs the most recent sample against the running
+	// average. Lower is smoother, higher reacts faster to change.
+	ewmaAlpha = 0.2
 )
 
 func init() {
 	coremain.RegNewPluginFunc(PluginType, Init, func() any { return new(Args) })
 }
 
-type fallback struct {
-	logger               *zap.Logger
-	primary              sequence.Executable
-	secondary            sequence.Executable
-	fastFallbackDuration time.Duration
-	alwaysStandby        bool
-	qCtxPool             *sync.Pool
-}
-
 type Args struct {
-	// Primary exec sequence.
-	Primary string `yaml:"primary"`
-	// Secondary exec sequence.
+	// Upstreams is the ordered list of exec sequence tags to race. At
+	// least two are required.
+	Upstreams []string `yaml:"upstreams"`
+
+	// Deprecated: use Upstreams. Primary/Secondary describe the same
+	// two-branch setup Args used before hedging was generalized to N
+	// branches; they are folded into Upstreams if Upstreams is empty.
+	Primary   string `yaml:"primary"`
 	Secondary string `yaml:"secondary"`
 
-	// Threshold in milliseconds. Default is 500.
+	// Threshold in milliseconds. Used as the hedge delay floor for every
+	// branch after the leader, and as the always_standby wait. Default is 500.
 	Threshold int `yaml:"threshold"`
 
-	// AlwaysStandby: secondary should always stand by in fallback.
+	// AlwaysStandby: keep the slowest branch's result around so it can
+	// be returned if the leader ends up failing. Only meaningful with
+	// exactly two branches, mirroring the pre-hedging behavior.
 	AlwaysStandby bool `yaml:"always_standby"`
+
+	// MinSuccess requires this many branches to agree on the same
+	// RRset before a response is accepted. Useful for detecting a
+	// poisoned upstream. Default is 1 (first answer wins).
+	MinSuccess int `yaml:"min_success"`
+
+	// BestEffort: when MinSuccess > 1 and every branch finishes without
+	// reaching quorum, return whichever single answer did come back
+	// instead of failing the query. Default is false, since silently
+	// accepting an unconfirmed answer is exactly what MinSuccess exists
+	// to prevent.
+	BestEffort bool `yaml:"best_effort"`
+}
+
+func (a *Args) branches() ([]string, error) {
+	if len(a.Upstreams) > 0 {
+		if len(a.Upstreams) < 2 {
+			return nil, errors.New("upstreams must have at least 2 entries")
+		}
+		return a.Upstreams, nil
+	}
+	if len(a.Primary) == 0 || len(a.Secondary) == 0 {
+		return nil, errors.New("args missing upstreams, or primary/secondary")
+	}
+	return []string{a.Primary, a.Secondary}, nil
+}
+
+type fallback struct {
+	logger    *zap.Logger
+	branches  []*branch
+	threshold time.Duration
+
+	alwaysStandby bool // only applies when len(branches) == 2.
+	minSuccess    int
+	bestEffort    bool
+
+	qCtxPool *sync.Pool
+}
+
+// branch is one candidate exec sequence plus its running latency/failure
+// statistics, used to rank branches before each hedged race.
+type branch struct {
+	tag   string
+	exec  sequence.Executable
+	stats *branchStats
+}
+
+type branchStats struct {
+	mu sync.Mutex
+
+	rttEWMA     time.Duration
+	rttVarEWMA  time.Duration // used to approximate a p95 via rtt + 2*stddev
+	failEWMA    float64       // 0..1
+	initialized bool
+}
+
+func (s *branchStats) observe(rtt time.Duration, failed bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var sample float64
+	if failed {
+		sample = 1
+	}
+	if !s.initialized {
+		s.rttEWMA = rtt
+		s.failEWMA = sample
+		s.initialized = true
+		return
+	}
+	diff := rtt - s.rttEWMA
+	s.rttEWMA += time.Duration(ewmaAlpha * float64(diff))
+	s.rttVarEWMA += time.Duration(ewmaAlpha * (math.Abs(float64(diff)) - float64(s.rttVarEWMA)))
+	s.failEWMA += ewmaAlpha * (sample - s.failEWMA)
+}
+
+// snapshot returns the branch's current score (lower is better), its
+// estimated p95 latency, and whether it has any data yet.
+func (s *branchStats) snapshot() (score float64, p95 time.Duration, hasData bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.initialized {
+		return 0, defaultFallbackThreshold, false
+	}
+	p95 = s.rttEWMA + 2*s.rttVarEWMA
+	// Penalize branches that fail often: the score is the rtt scaled by
+	// (1 + fail rate), so a branch that fails half the time scores 1.5x
+	// its rtt.
+	score = float64(s.rttEWMA) * (1 + s.failEWMA)
+	return score, p95, true
 }
 
 func Init(bp *coremain.BP, args any) (any, error) {
-	return newFallbackPlugin(bp, args.(*Args))
+	f, err := newFallbackPlugin(bp, args.(*Args))
+	if err != nil {
+		return nil, err
+	}
+	bp.RegAPI(f.Api())
+	return f, nil
 }
 
 func newFallbackPlugin(bp *coremain.BP, args *Args) (*fallback, error) {
-	if len(args.Primary) == 0 || len(args.Secondary) == 0 {
-		return nil, errors.New("args missing primary or secondary")
+	tags, err := args.branches()
+	if err != nil {
+		return nil, err
 	}
 
-	pe := sequence.ToExecutable(bp.M().GetPlugin(args.Primary))
-	if pe == nil {
-		return nil, fmt.Errorf("can not find primary executable %s", args.Primary)
-	}
-	se := sequence.ToExecutable(bp.M().GetPlugin(args.Secondary))
-	if se == nil {
-		return nil, fmt.Errorf("can not find secondary executable %s", args.Secondary)
+	branches := make([]*branch, 0, len(tags))
+	for _, tag := range tags {
+		e := sequence.ToExecutable(bp.M().GetPlugin(tag))
+		if e == nil {
+			return nil, fmt.Errorf("can not find executable %s", tag)
+		}
+		branches = append(branches, &branch{tag: tag, exec: e, stats: &branchStats{}})
 	}
+
 	threshold := time.Duration(args.Threshold) * time.Millisecond
 	if threshold <= 0 {
 		threshold = defaultFallbackThreshold
 	}
 
+	minSuccess := args.MinSuccess
+	if minSuccess <= 0 {
+		minSuccess = 1
+	}
+
 	s := &fallback{
-		logger:               bp.L(),
-		primary:              pe,
-		secondary:            se,
-		fastFallbackDuration: threshold,
-		alwaysStandby:        args.AlwaysStandby,
+		logger:        bp.L(),
+		branches:      branches,
+		threshold:     threshold,
+		alwaysStandby: args.AlwaysStandby && len(branches) == 2,
+		minSuccess:    minSuccess,
+		bestEffort:    args.BestEffort,
 		qCtxPool: &sync.Pool{
 			New: func() any {
 				return query_context.NewContext()
@@ -86,7 +198,8 @@ func newFallbackPlugin(bp *coremain.BP, args *Args) (*fallback, error) {
 }
 
 var (
-	ErrFailed = errors.New("no valid response from both primary and secondary")
+	ErrFailed       = errors.New("no valid response from any branch")
+	ErrQuorumNotMet = errors.New("no branch combination reached min_success agreement")
 )
 
 var _ sequence.Executable = (*fallback)(nil)
@@ -95,97 +208,240 @@ func (f *fallback) Exec(ctx context.Context, qCtx *query_context.Context) error
 	return f.doFallback(ctx, qCtx)
 }
 
-func (f *fallback) doFallback(ctx context.Context, qCtx *query_context.Context) error {
-	respChan := make(chan *dns.Msg, 2) // resp could be nil.
-	primFailed := make(chan struct{})
-	primDone := make(chan struct{})
-	var wg sync.WaitGroup
-	wg.Add(2)
+type branchResult struct {
+	branch *branch
+	rank   int // hedge order this call ran at; 0 is the leader.
+	r      *dns.Msg
+	err    error
+	rtt    time.Duration
+}
 
-	// primary goroutine.
-	qCtxP := f.qCtxPool.Get().(*query_context.Context)
-	*qCtxP = *qCtx
-	go func() {
-		defer func() {
-			f.qCtxPool.Put(qCtxP)
-			wg.Done()
-		}()
-		ctx, cancel := makeDdlCtx(ctx, defaultParallelTimeout)
-		defer cancel()
-		err := f.primary.Exec(ctx, qCtxP)
-		if err != nil {
-			f.logger.Warn("primary error", qCtx.InfoField(), zap.Error(err))
+// rank returns branches sorted fastest-first using their current score.
+// Branches with no data yet are treated as average and placed after
+// branches with a known-good score but before known-bad ones.
+func (f *fallback) rank() []*branch {
+	type scored struct {
+		b     *branch
+		score float64
+		p95   time.Duration
+	}
+	ranked := make([]scored, len(f.branches))
+	for i, b := range f.branches {
+		score, p95, hasData := b.stats.snapshot()
+		if !hasData {
+			score = float64(f.threshold) // treat as "average" until proven otherwise.
 		}
+		ranked[i] = scored{b: b, score: score, p95: p95}
+	}
+	sort.SliceStable(ranked, func(i, j int) bool { return ranked[i].score < ranked[j].score })
 
-		r := qCtxP.R()
-		if err != nil || r == nil {
-			close(primFailed)
-			respChan <- nil
-		} else {
-			close(primDone)
-			respChan <- r
-		}
-	}()
+	out := make([]*branch, len(ranked))
+	for i, s := range ranked {
+		out[i] = s.b
+	}
+	return out
+}
 
-	// Secondary goroutine.
-	qCtxS := f.qCtxPool.Get().(*query_context.Context)
-	*qCtxS = *qCtx
-	go func() {
-		defer func() {
-			f.qCtxPool.Put(qCtxS)
-			wg.Done()
-		}()
-		if !f.alwaysStandby { // not always standby, wait here.
-			select {
-			case <-primDone: // primary is done, no need to exec this.
-				return
-			case <-primFailed: // primary failed
-			case <-time.After(f.fastFallbackDuration): // timed out
-			}
-		}
+func (f *fallback) doFallback(ctx context.Context, qCtx *query_context.Context) error {
+	ranked := f.rank()
 
-		ctx, cancel := makeDdlCtx(ctx, defaultParallelTimeout)
-		defer cancel()
-		err := f.secondary.Exec(ctx, qCtxS)
-		if err != nil {
-			f.logger.Warn("secondary error", qCtx.InfoField(), zap.Error(err))
-			respChan <- nil
-			return
-		}
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	resChan := make(chan branchResult, len(ranked))
+	var wg sync.WaitGroup
+	wg.Add(len(ranked))
 
-		r := qCtxS.R()
-		// always standby is enabled. Wait until secondary resp is needed.
-		if f.alwaysStandby && r != nil {
-			select {
-			case <-ctx.Done():
-			case <-primDone:
-			case <-primFailed: // only send secondary result when primary is failed.
-			case <-time.After(f.fastFallbackDuration): // or timed out.
+	for i, b := range ranked {
+		i, b := i, b
+		delay := f.hedgeDelay(i, ranked)
+		go func() {
+			defer wg.Done()
+			if delay > 0 {
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(delay):
+				}
 			}
-		}
-		respChan <- r
-	}()
+			f.runBranch(ctx, qCtx, b, i, resChan)
+		}()
+	}
 
 	go func() {
 		wg.Wait()
-		close(respChan)
+		close(resChan)
 	}()
 
-	for i := 0; i < 2; i++ {
+	return f.collect(ctx, cancel, resChan, qCtx)
+}
+
+// hedgeDelay returns how long to wait before starting the i-th ranked
+// branch: the fastest branch starts immediately, and each subsequent
+// branch waits for the larger of the configured threshold and the
+// current leader's estimated p95 latency, unless a response already
+// arrived. The always_standby case is a special case: the standby
+// always starts immediately, matching this plugin's pre-hedging
+// behavior.
+func (f *fallback) hedgeDelay(i int, ranked []*branch) time.Duration {
+	if i == 0 {
+		return 0
+	}
+	if f.alwaysStandby {
+		// Preserve the pre-hedging always_standby behavior: the standby
+		// starts immediately alongside the leader instead of waiting like
+		// a normal ranked hedge branch. always_standby only changes which
+		// response collect() picks, and when (after Threshold), not when
+		// the standby runs.
+		return 0
+	}
+	_, leaderP95, hasData := ranked[0].stats.snapshot()
+	delay := f.threshold
+	if hasData && leaderP95 > delay {
+		delay = leaderP95
+	}
+	return delay
+}
+
+func (f *fallback) runBranch(ctx context.Context, qCtx *query_context.Context, b *branch, rank int, out chan<- branchResult) {
+	qCtxCopy := f.qCtxPool.Get().(*query_context.Context)
+	*qCtxCopy = *qCtx
+	defer f.qCtxPool.Put(qCtxCopy)
+
+	ctx, cancel := makeDdlCtx(ctx, defaultParallelTimeout)
+	defer cancel()
+
+	start := time.Now()
+	err := b.exec.Exec(ctx, qCtxCopy)
+	rtt := time.Since(start)
+
+	r := qCtxCopy.R()
+	b.stats.observe(rtt, err != nil || r == nil)
+	if err != nil {
+		f.logger.Warn("branch error", zap.String("branch", b.tag), qCtx.InfoField(), zap.Error(err))
+	}
+
+	select {
+	case out <- branchResult{branch: b, rank: rank, r: r, err: err, rtt: rtt}:
+	case <-ctx.Done():
+	}
+}
+
+// collect waits for enough agreeing branches (per MinSuccess) or for
+// every branch to finish and fail.
+//
+// With AlwaysStandby (only meaningful for exactly two branches), the
+// leader (rank 0) is returned as soon as it succeeds, but the standby's
+// result is kept rather than discarded: if the leader instead fails, or
+// Threshold passes without a leader answer, the standby's answer is used
+// the moment it is available, whichever order the two finish in, instead
+// of racing to ErrFailed.
+func (f *fallback) collect(ctx context.Context, cancel context.CancelCauseFunc, resChan <-chan branchResult, qCtx *query_context.Context) error {
+	agree := make(map[string][]*dns.Msg)
+	var lastGood *dns.Msg
+	var leaderFailed bool
+	var standbyGood *dns.Msg
+
+	var thresholdC <-chan time.Time
+	var thresholdPassed bool
+	if f.alwaysStandby {
+		t := time.NewTimer(f.threshold)
+		defer t.Stop()
+		thresholdC = t.C
+	}
+
+	for {
 		select {
 		case <-ctx.Done():
 			return context.Cause(ctx)
-		case r := <-respChan:
-			if r == nil { // One of goroutines finished but failed.
+		case <-thresholdC:
+			thresholdPassed = true
+			if standbyGood != nil {
+				cancel(nil)
+				qCtx.SetResponse(standbyGood)
+				return nil
+			}
+		case res, ok := <-resChan:
+			if !ok {
+				if lastGood != nil {
+					if f.minSuccess > 1 && !f.bestEffort {
+						// Quorum was never reached and the caller hasn't
+						// opted into best-effort fallback: surface that as a
+						// distinct failure instead of returning an
+						// unconfirmed answer as if it were agreed upon.
+						return ErrQuorumNotMet
+					}
+					qCtx.SetResponse(lastGood) // best effort: return whatever we got even if MinSuccess wasn't reached.
+					return nil
+				}
+				return ErrFailed
+			}
+
+			if f.alwaysStandby {
+				if res.rank == 0 { // leader
+					if res.err == nil && res.r != nil {
+						cancel(nil)
+						qCtx.SetResponse(res.r)
+						return nil
+					}
+					leaderFailed = true
+					if standbyGood != nil {
+						cancel(nil)
+						qCtx.SetResponse(standbyGood)
+						return nil
+					}
+					continue
+				}
+				// standby
+				if res.err == nil && res.r != nil {
+					standbyGood = res.r
+					lastGood = res.r
+					if leaderFailed || thresholdPassed {
+						cancel(nil)
+						qCtx.SetResponse(res.r)
+						return nil
+					}
+				}
+				continue
+			}
+
+			if res.err != nil || res.r == nil {
 				continue
 			}
-			qCtx.SetResponse(r)
-			return nil
+			lastGood = res.r
+
+			if f.minSuccess <= 1 {
+				qCtx.SetResponse(res.r)
+				return nil
+			}
+			k := rrsetKey(res.r)
+			agree[k] = append(agree[k], res.r)
+			if len(agree[k]) >= f.minSuccess {
+				cancel(nil)
+				qCtx.SetResponse(res.r)
+				return nil
+			}
 		}
 	}
+}
 
-	// All goroutines finished but failed.
-	return ErrFailed
+// rrsetKey returns a coarse fingerprint of a response's answer section
+// so that responses from different branches can be compared. The ttl is
+// stripped and the owner name lowercased before fingerprinting: two
+// upstreams answering with the identical RRset but different remaining
+// ttls (the normal case, since they didn't cache it at the same instant)
+// or differing name case must still be recognized as agreeing.
+func rrsetKey(m *dns.Msg) string {
+	rrs := make([]string, 0, len(m.Answer))
+	for _, rr := range m.Answer {
+		rr = dns.Copy(rr)
+		rr.Header().Ttl = 0
+		rr.Header().Name = strings.ToLower(rr.Header().Name)
+		rrs = append(rrs, strings.ToLower(rr.String()))
+	}
+	sort.Strings(rrs)
+	b, _ := json.Marshal(rrs)
+	return string(b)
 }
 
 func makeDdlCtx(ctx context.Context, timeout time.Duration) (context.Context, func()) {
@@ -194,4 +450,34 @@ func makeDdlCtx(ctx context.Context, timeout time.Duration) (context.Context, fu
 		ddl = time.Now().Add(timeout)
 	}
 	return context.WithDeadline(ctx, ddl)
-}
\ No newline at end of file
+}
+
+// Api exposes per-branch stats so operators can see which upstream is
+// winning.
+func (f *fallback) Api() *chi.Mux {
+	r := chi.NewRouter()
+	r.Get("/stats", func(w http.ResponseWriter, req *http.Request) {
+		type branchStat struct {
+			Tag      string  `json:"tag"`
+			RttMs    float64 `json:"rtt_ms"`
+			FailRate float64 `json:"fail_rate"`
+			HasData  bool    `json:"has_data"`
+		}
+		out := make([]branchStat, 0, len(f.branches))
+		for _, b := range f.branches {
+			_, _, hasData := b.stats.snapshot()
+			fail := 0.0
+			rtt := 0.0
+			if hasData {
+				b.stats.mu.Lock()
+				fail = b.stats.failEWMA
+				rtt = float64(b.stats.rttEWMA.Milliseconds())
+				b.stats.mu.Unlock()
+			}
+			out = append(out, branchStat{Tag: b.tag, RttMs: rtt, FailRate: fail, HasData: hasData})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(out)
+	})
+	return r
+}
@@ -0,0 +1,118 @@
+package fallback
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/miekg/dns"
+)
+
+func newTestFallback(minSuccess int, bestEffort, alwaysStandby bool, branchTags ...string) *fallback {
+	branches := make([]*branch, 0, len(branchTags))
+	for _, tag := range branchTags {
+		branches = append(branches, &branch{tag: tag, stats: &branchStats{}})
+	}
+	return &fallback{
+		branches:      branches,
+		threshold:     defaultFallbackThreshold,
+		alwaysStandby: alwaysStandby,
+		minSuccess:    minSuccess,
+		bestEffort:    bestEffort,
+	}
+}
+
+func TestHedgeDelayLeaderStartsImmediately(t *testing.T) {
+	f := newTestFallback(1, false, false, "a", "b")
+	ranked := f.rank()
+	if d := f.hedgeDelay(0, ranked); d != 0 {
+		t.Errorf("hedgeDelay(0) = %v, want 0", d)
+	}
+}
+
+func TestHedgeDelayAlwaysStandbyStartsImmediately(t *testing.T) {
+	f := newTestFallback(1, false, true, "a", "b")
+	ranked := f.rank()
+	if d := f.hedgeDelay(1, ranked); d != 0 {
+		t.Errorf("hedgeDelay(1) with always_standby = %v, want 0", d)
+	}
+}
+
+func TestHedgeDelayUsesThresholdFloorWithoutData(t *testing.T) {
+	f := newTestFallback(1, false, false, "a", "b")
+	ranked := f.rank()
+	if d := f.hedgeDelay(1, ranked); d != f.threshold {
+		t.Errorf("hedgeDelay(1) with no leader data = %v, want threshold %v", d, f.threshold)
+	}
+}
+
+func TestCollectQuorumNotMetWithoutBestEffort(t *testing.T) {
+	f := newTestFallback(2, false, false, "a", "b")
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+
+	resChan := make(chan branchResult, 2)
+	r := new(dns.Msg)
+	r.SetQuestion("example.com.", dns.TypeA)
+	resChan <- branchResult{branch: f.branches[0], r: r}
+	close(resChan)
+
+	qCtx := query_context.NewContext()
+	err := f.collect(ctx, cancel, resChan, qCtx)
+	if !errors.Is(err, ErrQuorumNotMet) {
+		t.Errorf("collect() err = %v, want ErrQuorumNotMet", err)
+	}
+}
+
+func TestCollectBestEffortReturnsUnconfirmedAnswer(t *testing.T) {
+	f := newTestFallback(2, true, false, "a", "b")
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+
+	resChan := make(chan branchResult, 2)
+	r := new(dns.Msg)
+	r.SetQuestion("example.com.", dns.TypeA)
+	resChan <- branchResult{branch: f.branches[0], r: r}
+	close(resChan)
+
+	qCtx := query_context.NewContext()
+	if err := f.collect(ctx, cancel, resChan, qCtx); err != nil {
+		t.Fatalf("collect() err = %v, want nil with best_effort", err)
+	}
+	if qCtx.R() != r {
+		t.Errorf("collect() did not set the best-effort response")
+	}
+}
+
+func TestCollectQuorumMetReturnsAgreedAnswer(t *testing.T) {
+	f := newTestFallback(2, false, false, "a", "b")
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+
+	resChan := make(chan branchResult, 2)
+	r1 := new(dns.Msg)
+	r1.SetQuestion("example.com.", dns.TypeA)
+	r1.Answer = []dns.RR{mustRR(t, "example.com. 300 IN A 1.2.3.4")}
+	r2 := dns.Copy(r1).(*dns.Msg)
+
+	resChan <- branchResult{branch: f.branches[0], r: r1}
+	resChan <- branchResult{branch: f.branches[1], r: r2}
+
+	qCtx := query_context.NewContext()
+	if err := f.collect(ctx, cancel, resChan, qCtx); err != nil {
+		t.Fatalf("collect() err = %v, want nil once quorum is met", err)
+	}
+	if qCtx.R() == nil {
+		t.Errorf("collect() did not set a response once quorum was met")
+	}
+}
+
+func mustRR(t *testing.T, s string) dns.RR {
+	t.Helper()
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		t.Fatalf("dns.NewRR(%q): %v", s, err)
+	}
+	return rr
+}
@@ -2,9 +2,12 @@ package base_domain
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"sync"
+	"runtime"
 	"strings"
+	"sync"
+	"sync/atomic"
 
 	"github.com/IrineSistiana/mosdns/v5/pkg/matcher/domain"
 	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
@@ -19,55 +22,130 @@ type Args struct {
 	Exps       []string `yaml:"exps"`
 	DomainSets []string `yaml:"domain_sets"`
 	Files      []string `yaml:"files"`
+
+	// StrictOrder forces sequential evaluation in m.mg's order instead
+	// of the default parallel fan-out, so that the first match is
+	// always the same one regardless of scheduling. Default is false.
+	StrictOrder bool `yaml:"strict_order"`
+
+	// ParallelThreshold is the minimum number of matchers in mg before
+	// Match bothers fanning out to a worker pool. Below it, matchers
+	// are just run sequentially on the calling goroutine. Default is 2.
+	ParallelThreshold int `yaml:"parallel_threshold"`
 }
 
 type MatchFunc func(qCtx *query_context.Context, m domain.Matcher[struct{}]) (bool, error)
 
 type Matcher struct {
-	match MatchFunc
-	mg    []domain.Matcher[struct{}]
+	match             MatchFunc
+	mg                []domain.Matcher[struct{}]
+	strictOrder       bool
+	parallelThreshold int
 }
 
-func (m *Matcher) Match(_ context.Context, qCtx *query_context.Context) (bool, error) {
+// Match runs m.mg's matchers and reports whether any of them matched.
+// Unless StrictOrder is set, matchers run concurrently on a worker pool
+// bounded by GOMAXPROCS. The first hit cancels ctx, so no further
+// matchers are started; Match returns once the matchers already running
+// have finished. Errors from every matcher that ran are joined together.
+func (m *Matcher) Match(ctx context.Context, qCtx *query_context.Context) (bool, error) {
+	if m.strictOrder || len(m.mg) < m.parallelThreshold {
+		return m.matchSequential(qCtx, m.mg)
+	}
+	return m.matchParallel(ctx, qCtx)
+}
+
+func (m *Matcher) matchSequential(qCtx *query_context.Context, mg []domain.Matcher[struct{}]) (bool, error) {
+	var errs []error
+	for _, matcher := range mg {
+		matched, err := m.match(qCtx, matcher)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if matched {
+			return true, errors.Join(errs...)
+		}
+	}
+	return false, errors.Join(errs...)
+}
+
+func (m *Matcher) matchParallel(ctx context.Context, qCtx *query_context.Context) (bool, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	poolSize := runtime.GOMAXPROCS(0)
+	if poolSize > len(m.mg) {
+		poolSize = len(m.mg)
+	}
+
+	jobs := make(chan domain.Matcher[struct{}])
 	var wg sync.WaitGroup
+	var matched atomic.Bool
 	var mu sync.Mutex
-	var matched bool
-	var firstErr error
+	var errs []error
 
-	for _, matcher := range m.mg {
-		wg.Add(1)
-		go func(m domain.Matcher[struct{}]) {
-			defer wg.Done()
-			matched, err := m.match(qCtx, m)
-			if err != nil && firstErr == nil {
-				mu.Lock()
-				firstErr = err
-				mu.Unlock()
+	worker := func() {
+		defer wg.Done()
+		for matcher := range jobs {
+			if ctx.Err() != nil {
+				return
 			}
-			if matched {
+			ok, err := m.match(qCtx, matcher)
+			if err != nil {
 				mu.Lock()
-				matched = true
+				errs = append(errs, err)
 				mu.Unlock()
+				continue
+			}
+			if ok {
+				matched.Store(true)
+				cancel()
+				return
 			}
-		}(matcher)
+		}
 	}
 
-	wg.Wait()
+	wg.Add(poolSize)
+	for i := 0; i < poolSize; i++ {
+		go worker()
+	}
 
-	if firstErr != nil {
-		return false, firstErr
+feed:
+	for _, matcher := range m.mg {
+		select {
+		case jobs <- matcher:
+		case <-ctx.Done():
+			break feed
+		}
 	}
+	close(jobs)
+	wg.Wait()
 
-	return matched, nil
+	mu.Lock()
+	defer mu.Unlock()
+	return matched.Load(), errors.Join(errs...)
 }
 
+const defaultParallelThreshold = 2
+
 func NewMatcher(bq sequence.BQ, args *Args, f MatchFunc) (m *Matcher, err error) {
+	parallelThreshold := args.ParallelThreshold
+	if parallelThreshold <= 0 {
+		parallelThreshold = defaultParallelThreshold
+	}
 	m = &Matcher{
-		match: f,
+		match:             f,
+		strictOrder:       args.StrictOrder,
+		parallelThreshold: parallelThreshold,
 	}
 
-	// 预先分配 mg 的容量
-	totalMatchers := len(args.DomainSets) + (len(args.Exps) + len(args.Files) > 0)
+	// Pre-size mg: one entry per domain set, plus one more if an
+	// anonymous set gets built below from Exps/Files.
+	totalMatchers := len(args.DomainSets)
+	if len(args.Exps)+len(args.Files) > 0 {
+		totalMatchers++
+	}
 	m.mg = make([]domain.Matcher[struct{}], 0, totalMatchers)
 
 	// Acquire matchers from other plugins.
@@ -116,4 +194,4 @@ func ParseQuickSetupArgs(s string) *Args {
 		}
 	}
 	return args
-}
\ No newline at end of file
+}
@@ -0,0 +1,72 @@
+package base_domain
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/matcher/domain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/miekg/dns"
+)
+
+// buildRealisticMatchers returns n domain sets of size setSize, each
+// loaded with distinct domains, so a query matches at most one set; the
+// benchmark query matches none, the worst case for both the sequential
+// and parallel paths.
+func buildRealisticMatchers(n, setSize int) []domain.Matcher[struct{}] {
+	mg := make([]domain.Matcher[struct{}], 0, n)
+	for i := 0; i < n; i++ {
+		mm := domain.NewDomainMixMatcher()
+		for j := 0; j < setSize; j++ {
+			_ = mm.Add(fmt.Sprintf("domain%d-%d.example.", i, j), struct{}{})
+		}
+		mg = append(mg, mm)
+	}
+	return mg
+}
+
+func benchQCtx() *query_context.Context {
+	q := new(dns.Msg)
+	q.SetQuestion("no-such-match.example.", dns.TypeA)
+	return query_context.NewContext(q, nil)
+}
+
+func benchMatchFunc(qCtx *query_context.Context, m domain.Matcher[struct{}]) (bool, error) {
+	q := qCtx.Q()
+	if len(q.Question) == 0 {
+		return false, nil
+	}
+	_, ok := m.Match(q.Question[0].Name)
+	return ok, nil
+}
+
+// BenchmarkMatchSequential and BenchmarkMatchParallel compare the two
+// fan-out strategies Match can take on a realistic number of domain
+// sets, each with a realistic number of entries, for a query that
+// matches nothing (so every matcher actually runs).
+func runMatchBenchmark(b *testing.B, strictOrder bool, numSets, setSize int) {
+	m := &Matcher{
+		match:             benchMatchFunc,
+		mg:                buildRealisticMatchers(numSets, setSize),
+		strictOrder:       strictOrder,
+		parallelThreshold: defaultParallelThreshold,
+	}
+	qCtx := benchQCtx()
+	ctx := context.Background()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := m.Match(ctx, qCtx); err != nil {
+			b.Fatalf("Match: %v", err)
+		}
+	}
+}
+
+func BenchmarkMatchSequential(b *testing.B) {
+	runMatchBenchmark(b, true, 8, 5000)
+}
+
+func BenchmarkMatchParallel(b *testing.B) {
+	runMatchBenchmark(b, false, 8, 5000)
+}
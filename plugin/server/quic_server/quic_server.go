@@ -17,138 +17,189 @@
  * along with this program.  If not, see <https://www.gnu.org/licenses/>.
  */
 
- package quic_server
-
- import (
-	 "crypto/tls"
-	 "errors"
-	 "fmt"
-	 "net"
-	 "sync"
-	 "time"
- 
-	 "github.com/IrineSistiana/mosdns/v5/coremain"
-	 "github.com/IrineSistiana/mosdns/v5/pkg/server"
-	 "github.com/IrineSistiana/mosdns/v5/pkg/utils"
-	 "github.com/IrineSistiana/mosdns/v5/plugin/server/server_utils"
-	 "github.com/quic-go/quic-go"
- )
- 
- const PluginType = "quic_server"
- 
- func init() {
-	 coremain.RegNewPluginFunc(PluginType, Init, func() any { return new(Args) })
- }
- 
- type Args struct {
-	 Entry       string `yaml:"entry"`
-	 Listen      string `yaml:"listen"`
-	 Cert        string `yaml:"key"`
-	 Key         string `yaml:"key"`
-	 IdleTimeout int    `yaml:"idle_timeout"`
- }
- 
- func (a *Args) init() error {
-	 if len(a.Key) == 0 || len(a.Cert) == 0 {
-		 return errors.New("quic server requires a tls certificate")
-	 }
-	 utils.SetDefaultNum(&a.IdleTimeout, 30)
-	 return nil
- }
- 
- type QuicServer struct {
-	 args *Args
- 
-	 l *quic.Listener
- }
- 
- func (s *QuicServer) Close() error {
-	 return s.l.Close()
- }
- 
- func Init(bp *coremain.BP, args any) (any, error) {
-	 return StartServer(bp, args.(*Args))
- }
- 
- var udpConnPool = sync.Pool{
-	 New: func() interface{} {
-		 conn, _ := net.ListenPacket("udp", "")
-		 return conn
-	 },
- }
- 
- func getUDPConn(addr string) (net.PacketConn, error) {
-	 conn := udpConnPool.Get().(net.PacketConn)
-	 defer func() {
-		 udpConnPool.Put(conn)
-	 }()
- 
-	 err := conn.SetDeadline(time.Now().Add(5 * time.Second))
-	 if err != nil {
-		 return nil, fmt.Errorf("failed to set deadline, %w", err)
-	 }
- 
-	 return conn, nil
- }
- 
- func StartServer(bp *coremain.BP, args *Args) (*QuicServer, error) {
-	 if err := args.init(); err != nil {
-		 return nil, fmt.Errorf("failed to initialize args, %w", err)
-	 }
- 
-	 dh, err := server_utils.NewHandler(bp, args.Entry)
-	 if err != nil {
-		 return nil, fmt.Errorf("failed to init dns handler, %w", err)
-	 }
- 
-	 tlsConfig := new(tls.Config)
-	 if err := server.LoadCert(tlsConfig, args.Cert, args.Key); err != nil {
-		 return nil, fmt.Errorf("failed to read tls cert, %w", err)
-	 }
-	 tlsConfig.NextProtos = []string{"doq"}
- 
-	 uc, err := getUDPConn(args.Listen)
-	 if err != nil {
-		 return nil, fmt.Errorf("failed to listen socket, %w", err)
-	 }
-	 defer uc.Close()
- 
-	 idleTimeout := time.Duration(args.IdleTimeout) * time.Second
- 
-	 quicConfig := &quic.Config{
-		 MaxIdleTimeout:                 idleTimeout,
-		 InitialStreamReceiveWindow:     4 * 1024,
-		 MaxStreamReceiveWindow:         4 * 1024,
-		 InitialConnectionReceiveWindow: 8 * 1024,
-		 MaxConnectionReceiveWindow:     16 * 1024,
-		 Allow0RTT:                      false,
-		 MaxIncomingUniStreams:          -1,
-	 }
- 
-	 srk, _, err := utils.InitQUICSrkFromIfaceMac()
-	 if err != nil {
-		 // No logging here
-	 }
-	 qt := &quic.Transport{
-		 Conn:              uc,
-		 StatelessResetKey: (*quic.StatelessResetKey)(srk),
-	 }
- 
-	 quicListener, err := qt.Listen(tlsConfig, quicConfig)
-	 if err != nil {
-		 qt.Close()
-		 return nil, fmt.Errorf("failed to listen quic, %w", err)
-	 }
- 
-	 go func() {
-		 defer quicListener.Close()
-		 serverOpts := server.DoQServerOpts{Logger: bp.L(), IdleTimeout: idleTimeout}
-		 err := server.ServeDoQ(quicListener, dh, serverOpts)
-		 bp.M().GetSafeClose().SendCloseSignal(err)
-	 }()
- 
-	 return &QuicServer{
-		 args: args,
-		 l:    quicListener,
-	 }, nil
- }
\ No newline at end of file
+package quic_server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/acme"
+	"github.com/IrineSistiana/mosdns/v5/pkg/server"
+	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
+	"github.com/IrineSistiana/mosdns/v5/plugin/server/server_utils"
+	"github.com/quic-go/quic-go"
+)
+
+const PluginType = "quic_server"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() any { return new(Args) })
+}
+
+// Defaults for the receive-window knobs: the small, DoQ-sized values this
+// server used to hardcode, not quic-go's own defaults.
+const (
+	defaultInitialStreamReceiveWindow     = 4 * 1024
+	defaultMaxStreamReceiveWindow         = 4 * 1024
+	defaultInitialConnectionReceiveWindow = 8 * 1024
+	defaultMaxConnectionReceiveWindow     = 16 * 1024
+)
+
+type Args struct {
+	Entry          string `yaml:"entry"`
+	Listen         string `yaml:"listen"`
+	Cert           string `yaml:"cert"`
+	Key            string `yaml:"key"`
+	MaxIdleTimeout int    `yaml:"max_idle_timeout"`
+
+	// ACME names an `acme:` top-level block to source the tls
+	// certificate from instead of Cert/Key. Domains is the set of
+	// names that block's Manager was asked to obtain a certificate for.
+	ACME        string   `yaml:"acme"`
+	ACMEDomains []string `yaml:"acme_domains"`
+
+	// ReusePort sets SO_REUSEPORT on the listening UDP socket so
+	// several quic_server instances (e.g. one per CPU) can bind the
+	// same Listen address, each with its own quic.Transport.
+	ReusePort bool `yaml:"reuse_port"`
+
+	// Allow0RTT enables QUIC 0-RTT, trading a round trip for exposure
+	// to replayed early-data queries. When set, queries arriving as
+	// early data are deduplicated through a sliding-window bloom
+	// filter (see ReplayWindowSize) before reaching the dns handler,
+	// per RFC 9250 §6's "0-RTT is only safe for idempotent,
+	// non-side-effecting requests" guidance.
+	Allow0RTT bool `yaml:"allow_0rtt"`
+	// ReplayWindowSize is the bit capacity of each of the two bloom
+	// filters. Default 1<<20 bits (128KiB), which keeps the
+	// false-positive (spurious rejection) rate near 1% for roughly 60k
+	// distinct early-data queries per 10s rotation.
+	ReplayWindowSize int `yaml:"replay_window_size"`
+
+	InitialStreamReceiveWindow     uint64 `yaml:"initial_stream_receive_window"`
+	MaxStreamReceiveWindow         uint64 `yaml:"max_stream_receive_window"`
+	InitialConnectionReceiveWindow uint64 `yaml:"initial_connection_receive_window"`
+	MaxConnectionReceiveWindow     uint64 `yaml:"max_connection_receive_window"`
+	EnableDatagrams                bool   `yaml:"enable_datagrams"`
+	DisablePathMTUDiscovery        bool   `yaml:"disable_path_mtu_discovery"`
+}
+
+func (a *Args) init() error {
+	if len(a.ACME) == 0 && (len(a.Key) == 0 || len(a.Cert) == 0) {
+		return errors.New("quic server requires a tls certificate")
+	}
+	utils.SetDefaultNum(&a.MaxIdleTimeout, 30)
+	utils.SetDefaultUnsignNum(&a.InitialStreamReceiveWindow, defaultInitialStreamReceiveWindow)
+	utils.SetDefaultUnsignNum(&a.MaxStreamReceiveWindow, defaultMaxStreamReceiveWindow)
+	utils.SetDefaultUnsignNum(&a.InitialConnectionReceiveWindow, defaultInitialConnectionReceiveWindow)
+	utils.SetDefaultUnsignNum(&a.MaxConnectionReceiveWindow, defaultMaxConnectionReceiveWindow)
+	if a.Allow0RTT {
+		utils.SetDefaultNum(&a.ReplayWindowSize, defaultReplayWindowBits)
+	}
+	return nil
+}
+
+type QuicServer struct {
+	args *Args
+
+	l  *quic.Listener
+	uc net.PacketConn
+}
+
+func (s *QuicServer) Close() error {
+	err := s.l.Close()
+	if ucErr := s.uc.Close(); err == nil {
+		err = ucErr
+	}
+	return err
+}
+
+func Init(bp *coremain.BP, args any) (any, error) {
+	return StartServer(bp, args.(*Args))
+}
+
+func StartServer(bp *coremain.BP, args *Args) (*QuicServer, error) {
+	if err := args.init(); err != nil {
+		return nil, fmt.Errorf("failed to initialize args, %w", err)
+	}
+
+	dh, err := server_utils.NewHandler(bp, args.Entry)
+	if err != nil {
+		return nil, fmt.Errorf("failed to init dns handler, %w", err)
+	}
+	if args.Allow0RTT {
+		dh = newReplayGuard(dh, args.ReplayWindowSize)
+	}
+
+	tlsConfig := new(tls.Config)
+	if len(args.ACME) > 0 {
+		m, ok := acme.Get(args.ACME)
+		if !ok {
+			return nil, fmt.Errorf("acme manager %s not found", args.ACME)
+		}
+		tlsConfig.GetCertificate = m.GetCertificate
+	} else if err := server.LoadCert(tlsConfig, args.Cert, args.Key); err != nil {
+		return nil, fmt.Errorf("failed to read tls cert, %w", err)
+	}
+	tlsConfig.NextProtos = []string{"doq"}
+
+	// A dedicated socket per server instance. The previous implementation
+	// pulled a conn from a sync.Pool and `defer`d it straight back while
+	// the quic.Transport kept using it underneath, so the pool could
+	// hand the same conn out to a second caller while this listener was
+	// still live on it. ReusePort, not a shared pool, is the supported
+	// way to run more than one of these on one host.
+	socketOpt := server_utils.ListenerSocketOpts{SO_REUSEPORT: args.ReusePort}
+	lc := net.ListenConfig{Control: server_utils.ListenerControl(socketOpt)}
+	uc, err := lc.ListenPacket(context.Background(), "udp", args.Listen)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen socket, %w", err)
+	}
+
+	idleTimeout := time.Duration(args.MaxIdleTimeout) * time.Second
+	quicConfig := &quic.Config{
+		MaxIdleTimeout:                 idleTimeout,
+		InitialStreamReceiveWindow:     args.InitialStreamReceiveWindow,
+		MaxStreamReceiveWindow:         args.MaxStreamReceiveWindow,
+		InitialConnectionReceiveWindow: args.InitialConnectionReceiveWindow,
+		MaxConnectionReceiveWindow:     args.MaxConnectionReceiveWindow,
+		Allow0RTT:                      args.Allow0RTT,
+		EnableDatagrams:                args.EnableDatagrams,
+		DisablePathMTUDiscovery:        args.DisablePathMTUDiscovery,
+		MaxIncomingUniStreams:          -1,
+	}
+
+	srk, _, err := utils.InitQUICSrkFromIfaceMac()
+	if err != nil {
+		// No logging here
+	}
+	qt := &quic.Transport{
+		Conn:              uc,
+		StatelessResetKey: (*quic.StatelessResetKey)(srk),
+	}
+
+	quicListener, err := qt.Listen(tlsConfig, quicConfig)
+	if err != nil {
+		qt.Close()
+		uc.Close()
+		return nil, fmt.Errorf("failed to listen quic, %w", err)
+	}
+
+	go func() {
+		defer quicListener.Close()
+		serverOpts := server.DoQServerOpts{Logger: bp.L(), IdleTimeout: idleTimeout}
+		err := server.ServeDoQ(quicListener, dh, serverOpts)
+		bp.M().GetSafeClose().SendCloseSignal(err)
+	}()
+
+	return &QuicServer{
+		args: args,
+		l:    quicListener,
+		uc:   uc,
+	}, nil
+}
@@ -0,0 +1,159 @@
+package quic_server
+
+import (
+	"context"
+	"hash/fnv"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/pkg/server"
+	"github.com/miekg/dns"
+)
+
+const (
+	defaultReplayWindowBits = 1 << 20 // 128KiB bloom filter.
+	replayWindowRotation    = 10 * time.Second
+	replayBloomHashes       = 3
+)
+
+var _ server.Handler = (*replayGuard)(nil)
+
+// replayGuard sits in front of the real dns handler and refuses 0-RTT
+// early-data queries it has already seen within the current sliding
+// window, per RFC 9250 §6's guidance that 0-RTT is only safe for
+// idempotent, non-side-effecting requests. DNS queries are idempotent,
+// but replaying one still lets an attacker re-trigger upstream lookups
+// or amplify traffic, so repeats within the window are rejected instead
+// of forwarded.
+//
+// A query carried on an ordinary 1-RTT stream can't have been replayed
+// by a network attacker the way early data can, so it is passed straight
+// through: qCtx.Is0RTT reports whether the doq server accepted this
+// particular query before the handshake finished, and only that subset
+// is deduplicated. Treating every query on a 0-RTT-capable connection as
+// suspect would refuse legitimate repeats (NAT-shared clients, stub
+// resolver retransmits) of ordinary, already-authenticated traffic.
+type replayGuard struct {
+	next   server.Handler
+	filter *slidingBloom
+}
+
+func newReplayGuard(next server.Handler, windowBits int) *replayGuard {
+	return &replayGuard{next: next, filter: newSlidingBloom(windowBits)}
+}
+
+func (g *replayGuard) ServeDNS(ctx context.Context, qCtx *query_context.Context) error {
+	q := qCtx.Q()
+	if len(q.Question) != 1 || !qCtx.Is0RTT() {
+		return g.next.ServeDNS(ctx, qCtx)
+	}
+
+	tuple := replayTuple(q, qCtx.RemoteAddr())
+	if g.filter.testAndAdd(tuple) {
+		m := new(dns.Msg)
+		m.SetRcode(q, dns.RcodeRefused)
+		qCtx.SetResponse(m)
+		return nil
+	}
+	return g.next.ServeDNS(ctx, qCtx)
+}
+
+func replayTuple(q *dns.Msg, addr net.Addr) string {
+	question := q.Question[0]
+	var ip string
+	if addr != nil {
+		if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+			ip = host
+		} else {
+			ip = addr.String()
+		}
+	}
+	return question.Name + "|" + strconv.Itoa(int(question.Qtype)) + "|" + ip
+}
+
+// slidingBloom is two bloom filters, one being written to and one kept
+// read-only from the previous rotation, so a tuple seen near a rotation
+// boundary is still caught instead of the window silently resetting.
+type slidingBloom struct {
+	mu       sync.Mutex
+	cur      *bloom
+	prev     *bloom
+	bits     int
+	rotateAt time.Time
+}
+
+func newSlidingBloom(bits int) *slidingBloom {
+	if bits <= 0 {
+		bits = defaultReplayWindowBits
+	}
+	return &slidingBloom{
+		cur:      newBloom(bits),
+		prev:     newBloom(bits),
+		bits:     bits,
+		rotateAt: time.Now().Add(replayWindowRotation),
+	}
+}
+
+// testAndAdd reports whether tuple was already present (in either half
+// of the window), then records it for future calls.
+func (s *slidingBloom) testAndAdd(tuple string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if time.Now().After(s.rotateAt) {
+		s.prev = s.cur
+		s.cur = newBloom(s.bits)
+		s.rotateAt = time.Now().Add(replayWindowRotation)
+	}
+
+	seen := s.prev.test(tuple) || s.cur.test(tuple)
+	s.cur.add(tuple)
+	return seen
+}
+
+// bloom is a minimal fixed-size bloom filter; false positives (treating
+// a fresh tuple as a replay) are acceptable here since the cost is an
+// occasional spurious REFUSED answer, not a correctness bug.
+type bloom struct {
+	bits  []byte
+	nbits uint64
+}
+
+func newBloom(sizeBits int) *bloom {
+	return &bloom{bits: make([]byte, (sizeBits+7)/8), nbits: uint64(sizeBits)}
+}
+
+func (b *bloom) indexes(s string) [replayBloomHashes]uint64 {
+	h1 := fnvSum(s, 0)
+	h2 := fnvSum(s, 1)
+	var idx [replayBloomHashes]uint64
+	for i := range idx {
+		idx[i] = (h1 + uint64(i)*h2) % b.nbits
+	}
+	return idx
+}
+
+func (b *bloom) add(s string) {
+	for _, i := range b.indexes(s) {
+		b.bits[i/8] |= 1 << (i % 8)
+	}
+}
+
+func (b *bloom) test(s string) bool {
+	for _, i := range b.indexes(s) {
+		if b.bits[i/8]&(1<<(i%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func fnvSum(s string, salt byte) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte{salt})
+	_, _ = h.Write([]byte(s))
+	return h.Sum64()
+}